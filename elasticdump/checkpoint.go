@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var resume = flag.Bool("resume", false, "Continue the dumps that stopped where their checkpoints say, appending to the same files")
+
+// checkpoint is how far the dump of an index got. it's saved as <base>.checkpoint.json after
+// every page, once the page is on disk
+type checkpoint struct {
+	Index string `json:"index"`
+	// PIT is the Point-in-Time the dump was reading, it's reused on resume if it's still open
+	PIT    string            `json:"pit,omitempty"`
+	Slices []sliceCheckpoint `json:"slices"`
+	Docs   int64             `json:"docs"`
+	// Total is how many documents matched when the dump started
+	Total int64 `json:"total"`
+	// Parts are the files of the dump, the last one is the one being written
+	Parts    []partCheckpoint `json:"parts"`
+	Compress string           `json:"compress"`
+	Done     bool             `json:"done"`
+	// Query and Source are the searchQuery and searchSource of the dump, a resume with other
+	// ones would mix two different dumps in one file
+	Query  json.RawMessage `json:"query,omitempty"`
+	Source json.RawMessage `json:"source,omitempty"`
+
+	path string
+}
+
+// partCheckpoint is one file of a dump. Bytes is its size at the last checkpoint, anything after
+// it is from a page that wasn't checkpointed and is cut off on resume
+type partCheckpoint struct {
+	File  string `json:"file"`
+	Docs  int64  `json:"docs"`
+	Bytes int64  `json:"bytes"`
+}
+
+type sliceCheckpoint struct {
+	SearchAfter json.RawMessage `json:"search_after,omitempty"`
+	Docs        int64           `json:"docs"`
+	Done        bool            `json:"done"`
+}
+
+func newCheckpoint(index, base string, slices int) *checkpoint {
+	return &checkpoint{
+		Index:    index,
+		Slices:   make([]sliceCheckpoint, slices),
+		Query:    searchQuery,
+		Source:   searchSource,
+		Compress: *compress,
+		path:     base + ".checkpoint.json",
+	}
+}
+
+// findCheckpoint returns the newest checkpoint of index in dir along with the base name of its
+// files, or nil if there's none
+func findCheckpoint(dir, host, index string) (*checkpoint, string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("ESDUMP-%v-%v-*.checkpoint.json", host, index)))
+	if err != nil {
+		return nil, "", err
+	}
+	// the names end with an RFC3339 time, so the newest sorts last
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, "", err
+		}
+		cp := &checkpoint{}
+		if err := json.Unmarshal(b, cp); err != nil {
+			return nil, "", fmt.Errorf("%s: %w", path, err)
+		}
+		// the glob of index "logs" matches the files of "logs-1" too
+		if cp.Index != index {
+			continue
+		}
+		cp.path = path
+		return cp, strings.TrimSuffix(path, ".checkpoint.json"), nil
+	}
+	return nil, "", nil
+}
+
+// save replaces the checkpoint file, through a rename so a crash never leaves half of one
+func (cp *checkpoint) save() error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(cp.path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(cp.path+".tmp", cp.path)
+}
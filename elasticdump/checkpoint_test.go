@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// readDump returns the documents in the parts of the dump of cp, in the order they're in
+func readDump(t *testing.T, dir string, cp *checkpoint) []gjson.Result {
+	t.Helper()
+	var docs []gjson.Result
+	for _, part := range cp.Parts {
+		r, err := openPart(filepath.Join(dir, part.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			docs = append(docs, gjson.Parse(scanner.Text()))
+		}
+		r.Close()
+		if err := scanner.Err(); err != nil {
+			t.Fatalf("%s: %s", part.File, err)
+		}
+	}
+	return docs
+}
+
+// failedDump starts the dump of index "logs" with searches that fail after 3 pages, and returns
+// its checkpoint
+func failedDump(t *testing.T, f *fakeCluster, c *esClient) *checkpoint {
+	t.Helper()
+	f.failAfter = 3
+	cp, err := indexToJSON(c, "logs")
+	if err == nil {
+		t.Fatal("no error from a dump whose searches fail")
+	}
+	if cp == nil || cp.Done || cp.Docs != 12 {
+		t.Fatalf("checkpoint after the failure is %+v, want 12 documents and not done", cp)
+	}
+	f.failAfter = 0
+	return cp
+}
+
+func TestResumeFromPointInTime(t *testing.T) {
+	setFlag(t, "outputDir", t.TempDir())
+	setFlag(t, "paging", "pit")
+	setFlag(t, "pageSize", "4")
+	setFlag(t, "slices", "2")
+	setFlag(t, "resume", "true")
+	f, c := newFakeCluster(t, "logs", 25)
+	dir := filepath.Join(*outputDir, c.host)
+	first := failedDump(t, f, c)
+
+	// a page that was written but not checkpointed when the dump stopped is cut off on resume
+	file, err := os.OpenFile(filepath.Join(dir, first.Parts[0].File), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"_index":"logs","_id":"x","_source":{"n":1000}}` + "\n")
+	file.Close()
+
+	cp, err := indexToJSON(c, "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cp.Done || cp.path != first.path {
+		t.Errorf("resumed dump is %s, done %v, want %s continued", cp.path, cp.Done, first.path)
+	}
+	if f.pitSeq != 1 {
+		t.Errorf("opened %d Points-in-Time, want the first one reused", f.pitSeq)
+	}
+	wantNumbers(t, docNumbers(readDump(t, dir, cp)), 25)
+
+	// a finished dump isn't read again
+	pages := f.pages
+	if cp, err := indexToJSON(c, "logs"); err != nil || !cp.Done || f.pages != pages {
+		t.Errorf("resuming a finished dump searched %d pages, err %v", f.pages-pages, err)
+	}
+}
+
+func TestResumeStartsOver(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		paging string
+		// expire closes the Point-in-Time between the two runs
+		expire bool
+	}{
+		{name: "expired Point-in-Time", paging: "pit", expire: true},
+		{name: "scroll", paging: "scroll"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setFlag(t, "outputDir", t.TempDir())
+			setFlag(t, "paging", tc.paging)
+			setFlag(t, "pageSize", "4")
+			setFlag(t, "slices", "2")
+			setFlag(t, "resume", "true")
+			f, c := newFakeCluster(t, "logs", 25)
+			failedDump(t, f, c)
+			if tc.expire {
+				f.pits = map[string]bool{}
+			}
+			pages := f.pages
+
+			cp, err := indexToJSON(c, "logs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the documents of a new search can't be matched to the ones already written, every
+			// one of them is read again
+			if !cp.Done || cp.Docs != 25 || f.pages-pages != 7 {
+				t.Errorf("dump done %v with %d documents in %d pages, want 25 in 7", cp.Done, cp.Docs, f.pages-pages)
+			}
+			wantNumbers(t, docNumbers(readDump(t, filepath.Join(*outputDir, c.host), cp)), 25)
+		})
+	}
+}
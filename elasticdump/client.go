@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var endpoint = flag.String("endpoint", "", "Cluster URL, e.g. https://es.example.com:9200. Overrides -targetIP and -targetPort")
+var username = flag.String("username", "", "Username for basic auth")
+var password = flag.String("password", os.Getenv("ELASTICDUMP_PASSWORD"), "Password for basic auth, defaults to $ELASTICDUMP_PASSWORD")
+var apiKey = flag.String("apiKey", os.Getenv("ELASTICDUMP_API_KEY"), "Base64 encoded API key, defaults to $ELASTICDUMP_API_KEY. Takes precedence over basic auth")
+var caFile = flag.String("caFile", "", "PEM file with the CA certificates to trust")
+var certFile = flag.String("certFile", "", "PEM client certificate for mTLS")
+var keyFile = flag.String("keyFile", "", "PEM client key for mTLS")
+var insecureSkipVerify = flag.Bool("insecureSkipVerify", false, "Don't verify the cluster's certificate")
+var requestTimeout = flag.Duration("requestTimeout", 5*time.Minute, "Timeout of each request to the cluster")
+
+// esClient sends every request to the cluster, with the same connection pool, TLS settings and credentials
+type esClient struct {
+	endpoint string
+	host     string
+	http     *http.Client
+	info     clusterInfo
+}
+
+func newClient() (*esClient, error) {
+	base := *endpoint
+	if base == "" {
+		base = fmt.Sprintf("http://%s:%d", *targetIP, *targetPort)
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("-endpoint must start with http:// or https://")
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: *insecureSkipVerify}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if *certFile != "" || *keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	// every index is dumped at the same time
+	transport.MaxIdleConnsPerHost = 32
+
+	return &esClient{
+		endpoint: strings.TrimSuffix(u.String(), "/"),
+		host:     u.Hostname(),
+		http:     &http.Client{Transport: transport, Timeout: *requestTimeout},
+	}, nil
+}
+
+// do sends a request to path, which starts with a /, and returns the response body. responses
+// other than 2xx are returned as errors
+func (c *esClient) do(method, path string, body []byte) ([]byte, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.endpoint+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if *apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+*apiKey)
+	} else if *username != "" {
+		req.SetBasicAuth(*username, *password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	resBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := resBytes
+		if len(msg) > 512 {
+			msg = msg[:512]
+		}
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resBytes, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tidwall/gjson"
+)
+
+var includeHidden = flag.Bool("includeHidden", false, "Also dump hidden and system indices, like the ones starting with a dot. Backing indices of data streams are always included")
+
+// clusterInfo is the flavor and version of the cluster, from GET /. Major is 0 when they're
+// unknown, and everything is tried the way the newest versions do it
+type clusterInfo struct {
+	Name    string
+	Flavor  string
+	Version string
+	Major   int
+	Minor   int
+	// dataStreams maps the backing indices of data streams to their data stream
+	dataStreams map[string]string
+}
+
+// detect finds out the flavor and version of the cluster, Elasticsearch 5 to 8 and OpenSearch 1
+// and 2 are supported
+func (c *esClient) detect() error {
+	resBytes, err := c.do("GET", "/", nil)
+	if err != nil {
+		return err
+	}
+	info := clusterInfo{
+		Name:    gjson.GetBytes(resBytes, "cluster_name").String(),
+		Flavor:  "elasticsearch",
+		Version: gjson.GetBytes(resBytes, "version.number").String(),
+	}
+	if gjson.GetBytes(resBytes, "version.distribution").String() == "opensearch" {
+		info.Flavor = "opensearch"
+	}
+	parts := strings.SplitN(info.Version, ".", 3)
+	info.Major, _ = strconv.Atoi(parts[0])
+	if len(parts) > 1 {
+		info.Minor, _ = strconv.Atoi(parts[1])
+	}
+	if info.Major == 0 {
+		return fmt.Errorf("unknown version %q", info.Version)
+	}
+	c.info = info
+	log.Infof("Cluster %s is %s %s", info.Name, info.Flavor, info.Version)
+	if (info.Flavor == "elasticsearch" && (info.Major < 5 || info.Major > 8)) || (info.Flavor == "opensearch" && info.Major > 2) {
+		log.Warnf("%s %s isn't supported, doing it the way the closest supported version does", info.Flavor, info.Version)
+	}
+	return nil
+}
+
+func (i clusterInfo) elasticsearch(major, minor int) bool {
+	return i.Flavor == "elasticsearch" && (i.Major > major || (i.Major == major && i.Minor >= minor))
+}
+
+// pit is whether the cluster has Point-in-Time with the _shard_doc sort, Elasticsearch 7.12 and
+// later. OpenSearch has its own Point-in-Time without _shard_doc, it's paged with scroll
+func (i clusterInfo) pit() bool {
+	return i.Major == 0 || i.elasticsearch(7, 12)
+}
+
+// hidden is whether the cluster has hidden indices, which came with Elasticsearch 7.7
+func (i clusterInfo) hidden() bool {
+	return i.Major == 0 || i.Flavor == "opensearch" || i.elasticsearch(7, 7)
+}
+
+// typedMappings is whether the mappings of the cluster have a type name level, before
+// Elasticsearch 7
+func (i clusterInfo) typedMappings() bool {
+	return i.Flavor == "elasticsearch" && i.Major != 0 && i.Major < 7
+}
+
+// totalHits is whether searches take track_total_hits, otherwise hits.total is always exact
+func (i clusterInfo) totalHits() bool {
+	return i.Major == 0 || i.Flavor == "opensearch" || i.elasticsearch(7, 0)
+}
+
+// hitsTotal reads hits.total of a search response, a number before Elasticsearch 7 and an object
+// with a value after it
+func hitsTotal(resBytes []byte) int64 {
+	total := gjson.GetBytes(resBytes, "hits.total")
+	if total.IsObject() {
+		return total.Get("value").Int()
+	}
+	return total.Int()
+}
+
+// countDocs returns how many documents of index match the query of the flags
+func countDocs(c *esClient, index string) (int64, error) {
+	body := searchBody(map[string]interface{}{"size": 0})
+	delete(body, "_source")
+	if c.info.totalHits() {
+		body["track_total_hits"] = true
+	}
+	postData, _ := json.Marshal(body)
+	resBytes, err := c.do("POST", fmt.Sprintf("/%v/_search", url.PathEscape(index)), postData)
+	if err != nil {
+		return 0, err
+	}
+	return hitsTotal(resBytes), nil
+}
+
+// loadDataStreams fills in the backing indices of the data streams, on the clusters that have
+// them: Elasticsearch 7.9 and later, and OpenSearch
+func (c *esClient) loadDataStreams() {
+	c.info.dataStreams = map[string]string{}
+	if !(c.info.Major == 0 || c.info.Flavor == "opensearch" || c.info.elasticsearch(7, 9)) {
+		return
+	}
+	resBytes, err := c.do("GET", "/_data_stream", nil)
+	if err != nil {
+		log.Warnf("Could not list the data streams, their backing indices are dumped like any hidden index: %s", err)
+		return
+	}
+	gjson.GetBytes(resBytes, "data_streams").ForEach(func(_, ds gjson.Result) bool {
+		ds.Get("indices").ForEach(func(_, index gjson.Result) bool {
+			c.info.dataStreams[index.Get("index_name").String()] = ds.Get("name").String()
+			return true
+		})
+		return true
+	})
+}
+
+// catIndices returns _cat/indices, with expandWildcards on the clusters that take it
+func catIndices(c *esClient, expandWildcards string) (gjson.Result, error) {
+	path := "/_cat/indices?format=json&bytes=kb"
+	if c.info.hidden() {
+		path += "&expand_wildcards=" + expandWildcards
+	}
+	resBytes, err := c.do("GET", path, nil)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return gjson.ParseBytes(resBytes), nil
+}
+
+// typelessMappings removes the type name level of mappings from before Elasticsearch 7, like
+// {"doc":{"properties":{...}}}, for the clusters that don't have types
+func typelessMappings(mappings string) string {
+	m := gjson.Parse(mappings)
+	if !m.IsObject() || m.Get("properties").Exists() {
+		return mappings
+	}
+	var typed []gjson.Result
+	m.ForEach(func(key, value gjson.Result) bool {
+		if value.IsObject() && value.Get("properties").Exists() {
+			typed = append(typed, value)
+		}
+		return true
+	})
+	if len(typed) != 1 || len(m.Map()) != 1 {
+		return mappings
+	}
+	return typed[0].Raw
+}
+
+// docType is the type name bulk actions need on the clusters with typed mappings: the one of the
+// dump's mappings if they have one, or the default type of the version
+func (i clusterInfo) docType(mappings string) string {
+	if !i.typedMappings() {
+		return ""
+	}
+	if typeless := typelessMappings(mappings); typeless != mappings {
+		for name := range gjson.Parse(mappings).Map() {
+			return name
+		}
+	}
+	if i.Major == 5 {
+		return "doc"
+	}
+	return "_doc"
+}
+
+// adaptMappings converts the mappings of a dump to what the cluster takes, with or without a
+// type name level
+func (i clusterInfo) adaptMappings(mappings, docType string) string {
+	if mappings == "" {
+		return ""
+	}
+	typeless := typelessMappings(mappings)
+	if docType == "" {
+		return typeless
+	}
+	if typeless != mappings {
+		return mappings
+	}
+	b, _ := json.Marshal(map[string]json.RawMessage{docType: json.RawMessage(mappings)})
+	return string(b)
+}
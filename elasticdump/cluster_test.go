@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// the GET / and _search responses of each supported version, as the clusters return them
+var clusterVersions = []struct {
+	name   string
+	root   string
+	search string
+
+	flavor        string
+	pit           bool
+	hidden        bool
+	typedMappings bool
+	totalHits     bool
+	// defaultType is the docType of typeless mappings
+	defaultType string
+}{
+	{
+		name:          "elasticsearch 5.6",
+		root:          `{"name":"node-1","cluster_name":"es5","cluster_uuid":"3dAxqAMbQmeFfhzbKzoVNw","version":{"number":"5.6.16","build_hash":"3a740d1","build_date":"2019-03-13T15:33:36.565Z","build_snapshot":false,"lucene_version":"6.6.1"},"tagline":"You Know, for Search"}`,
+		search:        `{"took":1,"timed_out":false,"_shards":{"total":5,"successful":5,"skipped":0,"failed":0},"hits":{"total":42,"max_score":0.0,"hits":[]}}`,
+		flavor:        "elasticsearch",
+		typedMappings: true,
+		defaultType:   "doc",
+	},
+	{
+		name:          "elasticsearch 6.8",
+		root:          `{"name":"node-1","cluster_name":"es6","cluster_uuid":"Zq0cO1RlQ3eAc8FZw4Yv3g","version":{"number":"6.8.23","build_flavor":"default","build_type":"docker","build_hash":"4f67856","build_date":"2022-01-06T21:30:50.087716Z","build_snapshot":false,"lucene_version":"7.7.3","minimum_wire_compatibility_version":"5.6.0","minimum_index_compatibility_version":"5.0.0"},"tagline":"You Know, for Search"}`,
+		search:        `{"took":1,"timed_out":false,"_shards":{"total":5,"successful":5,"skipped":0,"failed":0},"hits":{"total":42,"max_score":0.0,"hits":[]}}`,
+		flavor:        "elasticsearch",
+		typedMappings: true,
+		defaultType:   "_doc",
+	},
+	{
+		name:      "elasticsearch 7.17",
+		root:      `{"name":"node-1","cluster_name":"es7","cluster_uuid":"n5sXJ1CgRZSTKxVb8uX6Ow","version":{"number":"7.17.9","build_flavor":"default","build_type":"docker","build_hash":"ef48222227ee6b9e70e502f0f0daa52435ee634d","build_date":"2023-01-31T05:34:43.305517834Z","build_snapshot":false,"lucene_version":"8.11.1","minimum_wire_compatibility_version":"6.8.0","minimum_index_compatibility_version":"6.0.0-beta1"},"tagline":"You Know, for Search"}`,
+		search:    `{"took":1,"timed_out":false,"_shards":{"total":1,"successful":1,"skipped":0,"failed":0},"hits":{"total":{"value":42,"relation":"eq"},"max_score":null,"hits":[]}}`,
+		flavor:    "elasticsearch",
+		pit:       true,
+		hidden:    true,
+		totalHits: true,
+	},
+	{
+		name:      "elasticsearch 8.11",
+		root:      `{"name":"node-1","cluster_name":"es8","cluster_uuid":"1FqSp0fYQ9iBqv7VdHhR0A","version":{"number":"8.11.1","build_flavor":"default","build_type":"docker","build_hash":"6f9ff581fbcde658e6f69d6ce03050f060d1fd0c","build_date":"2023-11-11T10:05:59.421038163Z","build_snapshot":false,"lucene_version":"9.8.0","minimum_wire_compatibility_version":"7.17.0","minimum_index_compatibility_version":"7.0.0"},"tagline":"You Know, for Search"}`,
+		search:    `{"took":1,"timed_out":false,"_shards":{"total":1,"successful":1,"skipped":0,"failed":0},"hits":{"total":{"value":42,"relation":"eq"},"max_score":null,"hits":[]}}`,
+		flavor:    "elasticsearch",
+		pit:       true,
+		hidden:    true,
+		totalHits: true,
+	},
+	{
+		name:      "opensearch 1.3",
+		root:      `{"name":"node-1","cluster_name":"os1","cluster_uuid":"b8pAYp4vQ3mD0zBkqJ2o4g","version":{"distribution":"opensearch","number":"1.3.14","build_type":"tar","build_hash":"0b8c5a6b8e3a2f8c6f6f4b9e2c1d5b7a9e0f1c2d","build_date":"2023-12-07T20:28:13.426768Z","build_snapshot":false,"lucene_version":"8.10.1","minimum_wire_compatibility_version":"6.8.0","minimum_index_compatibility_version":"6.0.0-beta1"},"tagline":"The OpenSearch Project: https://opensearch.org/"}`,
+		search:    `{"took":1,"timed_out":false,"_shards":{"total":1,"successful":1,"skipped":0,"failed":0},"hits":{"total":{"value":42,"relation":"eq"},"max_score":null,"hits":[]}}`,
+		flavor:    "opensearch",
+		hidden:    true,
+		totalHits: true,
+	},
+	{
+		name:      "opensearch 2.11",
+		root:      `{"name":"node-1","cluster_name":"os2","cluster_uuid":"Jx1oT8dLS0Wq2c4Y9KpV7A","version":{"distribution":"opensearch","number":"2.11.1","build_type":"tar","build_hash":"6b1986e964d440be9137eba1413015c31c5a7752","build_date":"2023-11-29T21:43:10.135035992Z","build_snapshot":false,"lucene_version":"9.7.0","minimum_wire_compatibility_version":"7.10.0","minimum_index_compatibility_version":"7.0.0"},"tagline":"The OpenSearch Project: https://opensearch.org/"}`,
+		search:    `{"took":1,"timed_out":false,"_shards":{"total":1,"successful":1,"skipped":0,"failed":0},"hits":{"total":{"value":42,"relation":"eq"},"max_score":null,"hits":[]}}`,
+		flavor:    "opensearch",
+		hidden:    true,
+		totalHits: true,
+	},
+}
+
+func TestClusterVersions(t *testing.T) {
+	typeless := `{"properties":{"n":{"type":"long"}}}`
+	typed := `{"doc":{"properties":{"n":{"type":"long"}}}}`
+	for _, v := range clusterVersions {
+		t.Run(v.name, func(t *testing.T) {
+			var searched []byte
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/":
+					io.WriteString(w, v.root)
+				case "/logs/_search":
+					searched, _ = io.ReadAll(r.Body)
+					io.WriteString(w, v.search)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer srv.Close()
+			c := &esClient{endpoint: srv.URL, http: srv.Client()}
+			if err := c.detect(); err != nil {
+				t.Fatal(err)
+			}
+
+			if c.info.Flavor != v.flavor {
+				t.Errorf("flavor is %q, want %q", c.info.Flavor, v.flavor)
+			}
+			if got := c.info.pit(); got != v.pit {
+				t.Errorf("pit() is %v, want %v", got, v.pit)
+			}
+			if got := c.info.hidden(); got != v.hidden {
+				t.Errorf("hidden() is %v, want %v", got, v.hidden)
+			}
+			if got := c.info.typedMappings(); got != v.typedMappings {
+				t.Errorf("typedMappings() is %v, want %v", got, v.typedMappings)
+			}
+			if got := c.info.totalHits(); got != v.totalHits {
+				t.Errorf("totalHits() is %v, want %v", got, v.totalHits)
+			}
+
+			// hits.total is a number before Elasticsearch 7 and {"value"} after it
+			total, err := countDocs(c, "logs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != 42 {
+				t.Errorf("countDocs is %d, want 42", total)
+			}
+			if got := gjson.GetBytes(searched, "track_total_hits").Exists(); got != v.totalHits {
+				t.Errorf("track_total_hits sent: %v, want %v", got, v.totalHits)
+			}
+
+			if got := c.info.docType(typeless); got != v.defaultType {
+				t.Errorf("docType of typeless mappings is %q, want %q", got, v.defaultType)
+			}
+			wantTyped := ""
+			if v.typedMappings {
+				wantTyped = "doc"
+			}
+			if got := c.info.docType(typed); got != wantTyped {
+				t.Errorf("docType of typed mappings is %q, want %q", got, wantTyped)
+			}
+
+			// the mappings of a dump are given the type level the cluster needs, or lose it
+			want := map[string]string{typeless: typeless, typed: typeless}
+			if v.typedMappings {
+				want = map[string]string{typeless: `{"` + v.defaultType + `":` + typeless + `}`, typed: typed}
+			}
+			for mappings, adapted := range want {
+				if got := c.info.adaptMappings(mappings, c.info.docType(mappings)); got != adapted {
+					t.Errorf("adaptMappings(%s) is %s, want %s", mappings, got, adapted)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/tidwall/gjson"
+)
+
+var outputDir = flag.String("outputDir", ".", "Directory the dumps are written to, in a folder for each cluster host")
+var compress = flag.String("compress", "none", "Compress the dumps as they're written: none, gzip or zstd")
+var rotateMB = flag.Uint("rotateMB", 0, "Start a new part of a dump once it reaches this many MB on disk, 0 for no limit")
+var rotateDocs = flag.Uint("rotateDocs", 0, "Start a new part of a dump after this many documents, 0 for no limit")
+
+func checkOutputFlags() error {
+	if _, ok := compressExt[*compress]; !ok {
+		return fmt.Errorf("unknown -compress %s", *compress)
+	}
+	if *outputFormat == "parquet" && (*rotateMB != 0 || *rotateDocs != 0) {
+		return fmt.Errorf("-rotateMB and -rotateDocs don't apply to -outputFormat parquet")
+	}
+	if *parquetRowGroupMB < 1 {
+		return fmt.Errorf("-parquetRowGroupMB must be at least 1")
+	}
+	return nil
+}
+
+// pageWriter writes the pages of an index to its dump
+type pageWriter interface {
+	writePage(hits gjson.Result) error
+	Close() error
+}
+
+var compressExt = map[string]string{"none": "", "gzip": ".gz", "zstd": ".zst"}
+
+// dumpWriter writes the pages of an index to the parts of its dump. every page is compressed on
+// its own, as a gzip member or a zstd frame, so a part can be cut off after any checkpoint and
+// appended to on resume
+type dumpWriter struct {
+	base string
+	cp   *checkpoint
+	file *os.File
+	page bytes.Buffer
+	gz   *gzip.Writer
+	zs   *zstd.Encoder
+	// docType is the _type of the bulk actions, see bulkType
+	docType string
+}
+
+// partName is the file name of part n of the dump, only dumps with rotation have part numbers
+func (w *dumpWriter) partName(n int) string {
+	name := filepath.Base(w.base)
+	if *rotateMB != 0 || *rotateDocs != 0 {
+		name += fmt.Sprintf(".part%04d", n)
+	}
+	return name + ".ndjson" + compressExt[w.cp.Compress]
+}
+
+// openDump returns the writer of a dump, with the compression it started with
+func openDump(base string, cp *checkpoint, docType string) (pageWriter, error) {
+	if *outputFormat == "parquet" {
+		return openParquet(base, cp)
+	}
+	w := &dumpWriter{base: base, cp: cp, docType: docType}
+	switch cp.Compress {
+	case "gzip":
+		w.gz = gzip.NewWriter(io.Discard)
+	case "zstd":
+		zs, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		w.zs = zs
+	}
+	return w, nil
+}
+
+// current returns the part being written, opening it first. a part that already has something
+// in it is cut off at its last checkpoint
+func (w *dumpWriter) current() (*partCheckpoint, error) {
+	if len(w.cp.Parts) == 0 || w.full(&w.cp.Parts[len(w.cp.Parts)-1]) {
+		if w.file != nil {
+			if err := w.file.Close(); err != nil {
+				return nil, err
+			}
+			w.file = nil
+		}
+		w.cp.Parts = append(w.cp.Parts, partCheckpoint{File: w.partName(len(w.cp.Parts) + 1)})
+	}
+	part := &w.cp.Parts[len(w.cp.Parts)-1]
+	if w.file == nil {
+		file, err := os.OpenFile(filepath.Join(filepath.Dir(w.base), part.File), os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := file.Truncate(part.Bytes); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if _, err := file.Seek(part.Bytes, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+		w.file = file
+	}
+	return part, nil
+}
+
+func (w *dumpWriter) full(part *partCheckpoint) bool {
+	return (*rotateMB != 0 && part.Bytes >= int64(*rotateMB)<<20) || (*rotateDocs != 0 && part.Docs >= int64(*rotateDocs))
+}
+
+// writePage writes a page of hits, split over as many parts as -rotateDocs needs. the parts of
+// the checkpoint only count whole pages: when a write fails, they're set back and the file is
+// closed, so what made it to the disk is cut off when the part is opened again, like on resume
+func (w *dumpWriter) writePage(hits gjson.Result) (err error) {
+	parts := append([]partCheckpoint(nil), w.cp.Parts...)
+	defer func() {
+		if err != nil {
+			w.cp.Parts = parts
+			if w.file != nil {
+				w.file.Close()
+				w.file = nil
+			}
+		}
+	}()
+	all := hits.Array()
+	for len(all) != 0 {
+		part, err := w.current()
+		if err != nil {
+			return err
+		}
+		n := len(all)
+		if *rotateDocs != 0 && int64(n) > int64(*rotateDocs)-part.Docs {
+			n = int(int64(*rotateDocs) - part.Docs)
+		}
+		raws := make([]string, n)
+		for i, hit := range all[:n] {
+			raws[i] = hit.Raw
+		}
+		all = all[n:]
+
+		w.page.Reset()
+		var out io.Writer = &w.page
+		switch {
+		case w.gz != nil:
+			w.gz.Reset(&w.page)
+			out = w.gz
+		case w.zs != nil:
+			w.zs.Reset(&w.page)
+			out = w.zs
+		}
+		bw := bufio.NewWriter(out)
+		if err := writeHits(bw, gjson.Parse("["+strings.Join(raws, ",")+"]"), w.docType); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if closer, ok := out.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				return err
+			}
+		}
+		if _, err := w.file.Write(w.page.Bytes()); err != nil {
+			return err
+		}
+		part.Bytes += int64(w.page.Len())
+		part.Docs += int64(n)
+	}
+	return nil
+}
+
+func (w *dumpWriter) Close() error {
+	if w.zs != nil {
+		w.zs.Close()
+	}
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
+
+// openPart opens a part of a dump for reading, decompressing it by its extension
+func openPart(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(bufio.NewReader(file))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return readCloser{gz, file.Close}, nil
+	case strings.HasSuffix(path, ".zst"):
+		zs, err := zstd.NewReader(bufio.NewReader(file))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return readCloser{zs, func() error {
+			zs.Close()
+			return file.Close()
+		}}, nil
+	}
+	return file, nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error {
+	return r.close()
+}
+
+// dumpBase is the name a part of a dump and its sidecar files start with
+func dumpBase(path string) string {
+	for _, ext := range compressExt {
+		if ext != "" {
+			path = strings.TrimSuffix(path, ext)
+		}
+	}
+	path = strings.TrimSuffix(path, ".ndjson")
+	if i := strings.LastIndex(path, ".part"); i != -1 && len(path)-i == len(".part0000") {
+		path = path[:i]
+	}
+	return path
+}
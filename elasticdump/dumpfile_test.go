@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// testPage returns the hits of documents from to to-1, like the ones fakeCluster returns
+func testPage(from, to int) gjson.Result {
+	hits := make([]string, 0, to-from)
+	for n := from; n < to; n++ {
+		hits = append(hits, fmt.Sprintf(`{"_index":"logs","_id":"%d","_source":{"n":%d},"sort":[%d]}`, n, n, n))
+	}
+	return gjson.Parse("[" + strings.Join(hits, ",") + "]")
+}
+
+// copyCheckpoint returns a copy of cp, as it would be read back from its file
+func copyCheckpoint(t *testing.T, cp *checkpoint) *checkpoint {
+	t.Helper()
+	b, err := json.Marshal(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := &checkpoint{path: cp.path}
+	if err := json.Unmarshal(b, saved); err != nil {
+		t.Fatal(err)
+	}
+	return saved
+}
+
+// inOrder checks that docs are 0 to n-1, in that order
+func inOrder(t *testing.T, docs []gjson.Result, n int) {
+	t.Helper()
+	if len(docs) != n {
+		t.Errorf("got %d documents, want %d", len(docs), n)
+	}
+	for i, doc := range docs {
+		if got := doc.Get("_source.n").Int(); got != int64(i) {
+			t.Errorf("document %d is %d", i, got)
+			return
+		}
+	}
+}
+
+func TestDumpRotationAndResume(t *testing.T) {
+	for _, compression := range []string{"none", "gzip", "zstd"} {
+		t.Run(compression, func(t *testing.T) {
+			setFlag(t, "compress", compression)
+			setFlag(t, "rotateDocs", "10")
+			dir := t.TempDir()
+			base := filepath.Join(dir, "ESDUMP-fake-logs-2024-01-01T00:00:00Z")
+			cp := newCheckpoint("logs", base, 1)
+			w, err := openDump(base, cp, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for from := 0; from < 12; from += 4 {
+				if err := w.writePage(testPage(from, from+4)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// the dump stops after a page that didn't make it to the checkpoint
+			saved := copyCheckpoint(t, cp)
+			if err := w.writePage(testPage(12, 16)); err != nil {
+				t.Fatal(err)
+			}
+			w.Close()
+
+			w, err = openDump(base, saved, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for from := 12; from < 25; from += 4 {
+				to := from + 4
+				if to > 25 {
+					to = 25
+				}
+				if err := w.writePage(testPage(from, to)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// each page is a gzip member or zstd frame of its own, a part is read as one stream
+			inOrder(t, readDump(t, dir, saved), 25)
+			ext := compressExt[compression]
+			var want []string
+			for i := 1; i <= 3; i++ {
+				want = append(want, fmt.Sprintf("ESDUMP-fake-logs-2024-01-01T00:00:00Z.part%04d.ndjson%s", i, ext))
+			}
+			var docs []int64
+			for i, part := range saved.Parts {
+				if i >= len(want) || part.File != want[i] {
+					t.Errorf("part %d is %s, want %v", i, part.File, want)
+				}
+				docs = append(docs, part.Docs)
+			}
+			if fmt.Sprint(docs) != "[10 10 5]" {
+				t.Errorf("the parts have %v documents, want [10 10 5]", docs)
+			}
+		})
+	}
+}
+
+func TestDumpFailedWrite(t *testing.T) {
+	setFlag(t, "compress", "gzip")
+	dir := t.TempDir()
+	base := filepath.Join(dir, "ESDUMP-fake-logs-2024-01-01T00:00:00Z")
+	cp := newCheckpoint("logs", base, 1)
+	pw, err := openDump(base, cp, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := pw.(*dumpWriter)
+	if err := w.writePage(testPage(0, 4)); err != nil {
+		t.Fatal(err)
+	}
+	before := cp.Parts[0]
+
+	// the disk goes away under the dump
+	w.file.Close()
+	if err := w.writePage(testPage(4, 8)); err == nil {
+		t.Fatal("no error writing to a closed file")
+	}
+	if cp.Parts[0] != before {
+		t.Errorf("part after a failed write is %+v, want %+v", cp.Parts[0], before)
+	}
+
+	// the page is read again, and goes after the last whole one
+	if err := w.writePage(testPage(4, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	inOrder(t, readDump(t, dir, cp), 8)
+}
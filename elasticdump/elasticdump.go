@@ -1,14 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
-	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -16,11 +14,12 @@ import (
 	"github.com/tidwall/gjson"
 )
 
-var targetIP = flag.String("targetIP", "", "Target IP Address")
-var targetPort = flag.Uint("targetPort", 9200, "Target port")
+var targetIP = flag.String("targetIP", "", "Target IP Address, used when -endpoint is not set")
+var targetPort = flag.Uint("targetPort", 9200, "Target port, used when -endpoint is not set")
 var minDocCount = flag.Uint("minDocCount", 100, "Minimum number of Documents for each index")
 var minIndexSizeKB = flag.Uint("minIndexSizeKB", 1024, "Minimum size of index for dump")
 var indexRegex = flag.String("indexRegex", ".*", "Only download indices matching regex")
+var excludeRegex = flag.String("excludeRegex", "", "Don't download indices matching regex, even when they match -indexRegex")
 
 func checkFlags() {
 	flag.Parse()
@@ -28,8 +27,23 @@ func checkFlags() {
 		log.Fatal("-targetPort must be between 1 and 65535")
 	}
 
-	if *targetIP == "" {
-		log.Fatal("-targetIP is required")
+	if *targetIP == "" && *endpoint == "" {
+		log.Fatal("-endpoint or -targetIP is required")
+	}
+	if err := checkOutputFormat(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkPagingFlags(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkQueryFlags(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkOutputFlags(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkPlanFlags(); err != nil {
+		log.Fatal(err)
 	}
 }
 
@@ -40,95 +54,248 @@ func check(e error) {
 	}
 }
 
-func getNextScroll(ip string, port uint, scroll string, f *os.File) int {
-	postData := []byte(fmt.Sprintf(`{"scroll_id": "%v", "scroll": "10m"}`, scroll))
-	resp, err := http.Post(fmt.Sprintf("http://%s:%d/_search/scroll", ip, port), "application/json", bytes.NewBuffer(postData))
-	check(err)
-	defer resp.Body.Close()
-	resBytes, _ := ioutil.ReadAll(resp.Body)
-	Hits := gjson.GetBytes(resBytes, "hits.hits")
-	if Hits.Raw == "" || Hits.Raw == "[]" {
-		return 0
-	}
-	f.Write([]byte(Hits.Raw))
-	nextScroll := gjson.GetBytes(resBytes, "_scroll_id")
-	if nextScroll.Exists() {
-		getNextScroll(ip, port, nextScroll.String(), f)
-	}
-	return 0
+// indexResult is how the dump of an index ended. cp is nil when the dump couldn't start
+type indexResult struct {
+	index string
+	cp    *checkpoint
+	err   error
 }
 
-func indexToJSON(ip string, port uint, index string, done chan<- bool) (okay bool) {
-	defer func() {
-		done <- okay
-	}()
-	postData := []byte(`{"size": 1000}`)
-	resp, err := http.Post(fmt.Sprintf("http://%s:%d/%v/_search?scroll=10m", ip, port, index), "application/json", bytes.NewBuffer(postData))
-	check(err)
-	_ = os.Mkdir(fmt.Sprintf("./%v/", ip), 0755)
-	f, err := os.Create(fmt.Sprintf("./%v/ESDUMP-%v-%v-%v.json", ip, ip, index, time.Now().Format(time.RFC3339)))
-	check(err)
-	defer f.Close()
-	defer resp.Body.Close()
-	resBytes, _ := ioutil.ReadAll(resp.Body)
-	Hits := gjson.GetBytes(resBytes, "hits.hits")
-	if !(Hits.Raw == "" || Hits.Raw == "[]") {
-		f.Write([]byte(Hits.Raw))
+// indexToJSON dumps index and returns its checkpoint, or nil if it couldn't start
+func indexToJSON(c *esClient, index string) (*checkpoint, error) {
+	dir := filepath.Join(*outputDir, c.host)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
 	}
-	nextScroll := gjson.GetBytes(resBytes, "_scroll_id")
-	if nextScroll.Exists() {
-		_ = getNextScroll(ip, port, nextScroll.String(), f)
-
+	var cp *checkpoint
+	var base string
+	if *resume {
+		var err error
+		cp, base, err = findCheckpoint(dir, c.host, index)
+		if err != nil {
+			return nil, err
+		}
+		if cp != nil && cp.Done {
+			log.Infof("Index %s is already dumped in %s, skipping..", index, base)
+			return cp, nil
+		}
+		// a Parquet file can't be appended to once its footer is written
+		if cp != nil && *outputFormat == "parquet" {
+			log.Warnf("Parquet dumps can't be resumed, dumping %s from the start", index)
+			cp = nil
+		}
+		// the slices that have documents already can only continue in their Point-in-Time
+		if cp != nil && started(cp) && !(usePIT(c) && pitOpen(c, cp.PIT)) {
+			log.Warnf("The Point-in-Time of %s is gone or it was read with scroll, dumping it from the start", index)
+			cp = nil
+		}
+	}
+	if cp == nil {
+		base = filepath.Join(dir, fmt.Sprintf("ESDUMP-%v-%v-%v", c.host, index, time.Now().Format(time.RFC3339)))
+		cp = newCheckpoint(index, base, *slices)
+		if err := saveIndexMetadata(c, index, base); err != nil {
+			return cp, fmt.Errorf("saving the metadata: %w", err)
+		}
+		total, err := countDocs(c, index)
+		if err != nil {
+			log.Warnf("Could not count the documents of %s: %s", index, err)
+		}
+		cp.Total = total
+	} else {
+		if string(cp.Query) != string(searchQuery) || string(cp.Source) != string(searchSource) {
+			return nil, fmt.Errorf("can't resume, it was started with a different -query, -from, -to or _source filter")
+		}
+		if len(cp.Slices) != *slices {
+			log.Warnf("Resuming %s with the %d slices it started with", index, len(cp.Slices))
+		}
+		if cp.Compress != *compress {
+			log.Warnf("Resuming %s with the -compress %s it started with", index, cp.Compress)
+		}
+		log.Infof("Resuming %s after %d documents", index, cp.Docs)
+	}
+	w, err := openDump(base, cp, bulkType(c, index, base))
+	if err != nil {
+		return cp, fmt.Errorf("opening the dump: %w", err)
+	}
+	if err := dumpIndex(c, index, cp, w.writePage); err != nil {
+		w.Close()
+		return cp, fmt.Errorf("-resume continues from %d documents: %w", cp.Docs, err)
+	}
+	// a Parquet file is only readable once its footer is written
+	if err := w.Close(); err != nil {
+		return cp, fmt.Errorf("closing the dump: %w", err)
+	}
+	cp.Done = true
+	if err := cp.save(); err != nil {
+		return cp, err
+	}
+	if cp.Total != 0 && cp.Docs != cp.Total {
+		log.Warnf("Dumped %d documents of %s, it had %d when the dump started", cp.Docs, index, cp.Total)
 	}
-	return true
+	return cp, nil
 }
 
-func getIndexList(ip string, port uint, minDocCount uint, minIndexSizeKB uint, indexRe *regexp.Regexp) []string {
+// indexCandidate is an index of the cluster and what the filters make of it
+type indexCandidate struct {
+	Index          string `json:"index"`
+	DataStream     string `json:"data_stream,omitempty"`
+	Status         string `json:"status"`
+	Hidden         bool   `json:"hidden"`
+	DocsCount      int64  `json:"docs_count"`
+	StoreSizeKB    int64  `json:"store_size_kb"`
+	PriStoreSizeKB int64  `json:"pri_store_size_kb"`
+	DocCountOK     bool   `json:"min_doc_count_ok"`
+	SizeOK         bool   `json:"min_index_size_ok"`
+	RegexOK        bool   `json:"index_regex_ok"`
+	Excluded       bool   `json:"excluded"`
+	Selected       bool   `json:"selected"`
+	// Reason is why an index isn't selected
+	Reason string `json:"reason,omitempty"`
+	// MatchingDocs is filled in by -plan when there's a -query, -from or -to
+	MatchingDocs *int64 `json:"matching_docs,omitempty"`
+}
 
-	var resList []string
+// listIndices returns every index of the cluster with the result of each filter
+func listIndices(c *esClient, minDocCount uint, minIndexSizeKB uint, indexRe, excludeRe *regexp.Regexp) []indexCandidate {
+
+	var resList []indexCandidate
 
-	resp, err := http.Get(fmt.Sprintf("http://%s:%d/_cat/indices?format=json&bytes=kb", ip, port))
+	c.loadDataStreams()
+	all, err := catIndices(c, "all")
 	check(err)
-	defer resp.Body.Close()
-	bytes, _ := ioutil.ReadAll(resp.Body)
-	result := gjson.Parse(string(bytes))
-	result.ForEach(func(key, value gjson.Result) bool {
-
-		docCountInt, _ := strconv.Atoi(gjson.Get(value.String(), "docs\\.count").String())
-		indexSizeKB, _ := strconv.Atoi(gjson.Get(value.String(), "store\\.size").String())
-		if uint(docCountInt) >= minDocCount && uint(indexSizeKB) >= minIndexSizeKB {
-			indexName := gjson.Get(value.String(), "index").String()
-			// Checking index regex match
-			if indexRe.Match([]byte(indexName)) {
-				resList = append(resList, indexName)
-			} else {
-				log.Warnf("Index %s name did NOT match regex, skipping..", indexName)
-			}
-		} else {
-			log.Warnf("Index %s name did NOT meet document count and size requirements, skipping..", gjson.Get(value.String(), "index").String())
+	// hidden indices are the ones that only show up with expand_wildcards=all
+	visible := map[string]bool{}
+	if c.info.hidden() {
+		open, err := catIndices(c, "open")
+		check(err)
+		open.ForEach(func(_, value gjson.Result) bool {
+			visible[value.Get("index").String()] = true
+			return true
+		})
+	}
+	all.ForEach(func(key, value gjson.Result) bool {
+		index := indexCandidate{
+			Index:          value.Get("index").String(),
+			Status:         value.Get("status").String(),
+			DocsCount:      value.Get(`docs\.count`).Int(),
+			StoreSizeKB:    value.Get(`store\.size`).Int(),
+			PriStoreSizeKB: value.Get(`pri\.store\.size`).Int(),
+		}
+		index.DataStream = c.info.dataStreams[index.Index]
+		index.Hidden = strings.HasPrefix(index.Index, ".") || (c.info.hidden() && !visible[index.Index])
+		index.DocCountOK = uint(index.DocsCount) >= minDocCount
+		index.SizeOK = uint(index.StoreSizeKB) >= minIndexSizeKB
+		// backing indices match by their data stream too
+		matches := func(re *regexp.Regexp) bool {
+			return re.MatchString(index.Index) || (index.DataStream != "" && re.MatchString(index.DataStream))
+		}
+		index.RegexOK = matches(indexRe)
+		index.Excluded = excludeRe != nil && matches(excludeRe)
+		switch {
+		case index.Status == "close":
+			index.Reason = "closed"
+		case index.Hidden && index.DataStream == "" && !*includeHidden:
+			index.Reason = "hidden or system index"
+		case !index.DocCountOK || !index.SizeOK:
+			index.Reason = "below -minDocCount or -minIndexSizeKB"
+		case !index.RegexOK:
+			index.Reason = "doesn't match -indexRegex"
+		case index.Excluded:
+			index.Reason = "matches -excludeRegex"
+		default:
+			index.Selected = true
 		}
+		resList = append(resList, index)
 		return true
 	})
 	return resList
 }
 
+func getIndexList(c *esClient, minDocCount uint, minIndexSizeKB uint, indexRe, excludeRe *regexp.Regexp) []string {
+	var resList []string
+	for _, index := range listIndices(c, minDocCount, minIndexSizeKB, indexRe, excludeRe) {
+		switch {
+		case index.Selected:
+			resList = append(resList, index.Index)
+		case index.Hidden && index.DataStream == "" && !*includeHidden:
+			log.Infof("Index %s is hidden or a system index, skipping..", index.Index)
+		default:
+			log.Warnf("Index %s is skipped: %s", index.Index, index.Reason)
+		}
+	}
+	return resList
+}
+
+func detectCluster(c *esClient) {
+	if err := c.detect(); err != nil {
+		log.Warnf("Could not detect the cluster version, assuming a recent one: %s", err)
+	}
+}
+
 func main() {
 	log.Info("Starting ...")
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		checkFlags()
+		c, err := newClient()
+		check(err)
+		detectCluster(c)
+		if failed := restore(c); failed > 0 {
+			log.Fatalf("%d documents failed to restore", failed)
+		}
+		return
+	}
 	checkFlags()
 	indexRe := regexp.MustCompile(*indexRegex)
-	log.Infof("Getting index list from %s", *targetIP)
-	indexList := getIndexList(*targetIP, *targetPort, *minDocCount, *minIndexSizeKB, indexRe)
-	done := make(chan bool)
+	var excludeRe *regexp.Regexp
+	if *excludeRegex != "" {
+		excludeRe = regexp.MustCompile(*excludeRegex)
+	}
+	c, err := newClient()
+	check(err)
+	detectCluster(c)
+	if *paging == "pit" && !c.info.pit() {
+		log.Fatalf("-paging pit needs Elasticsearch 7.12 or later, the cluster is %s %s", c.info.Flavor, c.info.Version)
+	}
+	if *plan {
+		check(printPlan(os.Stdout, c, listIndices(c, *minDocCount, *minIndexSizeKB, indexRe, excludeRe)))
+		return
+	}
+	log.Infof("Getting index list from %s", c.endpoint)
+	indexList := getIndexList(c, *minDocCount, *minIndexSizeKB, indexRe, excludeRe)
+	dir := filepath.Join(*outputDir, c.host)
+	check(os.MkdirAll(dir, 0755))
+	run := newManifest(c)
+	base := filepath.Join(dir, fmt.Sprintf("ESDUMP-%v-%v", c.host, run.Started.Format(time.RFC3339)))
+	check(saveClusterMetadata(c, base))
+	done := make(chan indexResult)
+	// at most -concurrency indices are dumped at once
+	slots := make(chan struct{}, *concurrency)
 	for _, index := range indexList {
-		log.Infof("Getting index %s from %s", index, *targetIP)
-		go indexToJSON(*targetIP, *targetPort, index, done)
+		go func(index string) {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			log.Infof("Getting index %s from %s", index, c.endpoint)
+			cp, err := indexToJSON(c, index)
+			done <- indexResult{index, cp, err}
+		}(index)
 	}
 	// wait for everything to finish
 	errors := 0
 	for i := 0; i < len(indexList); i++ {
-		if !<-done {
-			log.Errorf("Error while doing index %s", indexList[i])
+		res := <-done
+		if res.err != nil {
+			log.Errorf("Could not dump %s: %s", res.index, res.err)
+		}
+		if res.err != nil || res.cp == nil || !res.cp.Done {
 			errors++
 		}
+		if res.cp != nil {
+			run.add(c, dir, res.cp)
+		}
+	}
+	check(run.write(base + ".manifest.json"))
+	if errors > 0 {
+		log.Fatalf("%d indices could not be dumped", errors)
 	}
 }
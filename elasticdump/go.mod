@@ -2,12 +2,24 @@ module github.com/mosajjal/go-exp/elasticdump
 
 go 1.22
 
-require github.com/sirupsen/logrus v1.9.3
+require (
+	github.com/klauspost/compress v1.17.9
+	github.com/sirupsen/logrus v1.9.3
+)
 
-require github.com/tidwall/match v1.1.1 // indirect
+require (
+	github.com/apache/arrow/go/arrow v0.0.0-20200730104253-651201b0f516 // indirect
+	github.com/apache/thrift v0.14.2 // indirect
+	github.com/golang/snappy v0.0.3 // indirect
+	github.com/pierrec/lz4/v4 v4.1.8 // indirect
+	github.com/tidwall/match v1.1.1 // indirect
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+)
 
 require (
 	github.com/tidwall/gjson v1.17.1
 	github.com/tidwall/pretty v1.2.1 // indirect
+	github.com/xitongsys/parquet-go v1.6.2
+	github.com/xitongsys/parquet-go-source v0.0.0-20241021075129-b732d2ac9c9b
 	golang.org/x/sys v0.21.0 // indirect
 )
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// manifest lists what a run dumped, with the sha256 of every file so an archived dump can be
+// verified. it's written as ESDUMP-<host>-<time>.manifest.json once every index is done
+type manifest struct {
+	Endpoint     string          `json:"endpoint"`
+	ClusterName  string          `json:"cluster_name,omitempty"`
+	Version      string          `json:"version,omitempty"`
+	Distribution string          `json:"distribution,omitempty"`
+	Started      time.Time       `json:"started"`
+	Finished     time.Time       `json:"finished"`
+	Indices      []manifestIndex `json:"indices"`
+}
+
+type manifestIndex struct {
+	Index      string `json:"index"`
+	DataStream string `json:"data_stream,omitempty"`
+	Complete   bool   `json:"complete"`
+	Docs       int64  `json:"docs"`
+	// Expected is how many documents matched when the dump started
+	Expected int64          `json:"expected_docs"`
+	Bytes    int64          `json:"bytes"`
+	Parts    []manifestPart `json:"parts"`
+}
+
+type manifestPart struct {
+	File   string `json:"file"`
+	Docs   int64  `json:"docs"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+func newManifest(c *esClient) *manifest {
+	return &manifest{
+		Endpoint:     c.endpoint,
+		ClusterName:  c.info.Name,
+		Version:      c.info.Version,
+		Distribution: c.info.Flavor,
+		Started:      time.Now(),
+	}
+}
+
+// add adds the dump of cp, hashing its parts in dir
+func (m *manifest) add(c *esClient, dir string, cp *checkpoint) {
+	entry := manifestIndex{Index: cp.Index, DataStream: c.info.dataStreams[cp.Index], Complete: cp.Done, Docs: cp.Docs, Expected: cp.Total}
+	for _, part := range cp.Parts {
+		sum, size, err := hashFile(filepath.Join(dir, part.File))
+		if err != nil {
+			log.Errorf("Could not hash %s: %s", part.File, err)
+		}
+		entry.Bytes += size
+		entry.Parts = append(entry.Parts, manifestPart{File: part.File, Docs: part.Docs, Bytes: size, SHA256: sum})
+	}
+	m.Indices = append(m.Indices, entry)
+}
+
+func (m *manifest) write(path string) error {
+	m.Finished = time.Now()
+	sort.Slice(m.Indices, func(i, j int) bool {
+		return m.Indices[i].Index < m.Indices[j].Index
+	})
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.Infof("Writing the manifest to %s", path)
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
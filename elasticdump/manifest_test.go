@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	parts := map[string]string{
+		"logs.part0001.ndjson": "{\"n\":0}\n{\"n\":1}\n",
+		"logs.part0002.ndjson": "{\"n\":2}\n",
+		"audit.ndjson":         "",
+	}
+	for name, content := range parts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &esClient{endpoint: "http://fake:9200", info: clusterInfo{Name: "fake", Flavor: "elasticsearch", Version: "8.11.1"}}
+	run := newManifest(c)
+	run.add(c, dir, &checkpoint{Index: "logs", Docs: 3, Total: 3, Done: true, Parts: []partCheckpoint{
+		{File: "logs.part0001.ndjson", Docs: 2},
+		{File: "logs.part0002.ndjson", Docs: 1},
+	}})
+	run.add(c, dir, &checkpoint{Index: "audit", Total: 7, Parts: []partCheckpoint{{File: "audit.ndjson"}}})
+	path := filepath.Join(dir, "run.manifest.json")
+	if err := run.write(path); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got manifest
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Indices) != 2 || got.Indices[0].Index != "audit" || got.Indices[1].Index != "logs" {
+		t.Fatalf("manifest indices are %+v, want audit and logs", got.Indices)
+	}
+	if audit := got.Indices[0]; audit.Complete || audit.Expected != 7 {
+		t.Errorf("unfinished index is %+v, want it incomplete with 7 expected documents", audit)
+	}
+	logs := got.Indices[1]
+	if !logs.Complete || logs.Docs != 3 || logs.Bytes != 24 {
+		t.Errorf("index is %+v, want it complete with 3 documents in 24 bytes", logs)
+	}
+	for _, part := range append(logs.Parts, got.Indices[0].Parts...) {
+		sum := sha256.Sum256([]byte(parts[part.File]))
+		if part.SHA256 != hex.EncodeToString(sum[:]) || part.Bytes != int64(len(parts[part.File])) {
+			t.Errorf("part %s has sha256 %s and %d bytes, want the ones of its file", part.File, part.SHA256, part.Bytes)
+		}
+	}
+}
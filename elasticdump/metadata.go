@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tidwall/gjson"
+)
+
+// settings the cluster sets on its own when an index is created, they can't be restored
+var nonPortableSettings = []string{"uuid", "creation_date", "creation_date_string", "provided_name", "version", "resize", "routing.allocation.initial_recovery", "history_uuid", "verified_before_close"}
+
+// clusterMetadata are the cluster wide objects saved once per dump, as <base>.<name>.json. they're
+// restored in this order, so component templates exist before the index templates made of them
+var clusterMetadata = []struct {
+	name string
+	path string
+}{
+	{"pipelines", "/_ingest/pipeline"},
+	{"component_templates", "/_component_template"},
+	{"index_templates", "/_index_template"},
+	{"legacy_templates", "/_template"},
+}
+
+// saveIndexMetadata writes the _mapping, _settings and _alias of an index next to its dump, as
+// <base>.mapping.json, <base>.settings.json and <base>.aliases.json, so restore can create the
+// index the same way. a backing index also gets <base>.data_stream.json with its data stream
+func saveIndexMetadata(c *esClient, index, base string) error {
+	for _, kind := range []string{"mapping", "settings", "alias"} {
+		resBytes, err := c.do("GET", fmt.Sprintf("/%v/_%v", url.PathEscape(index), kind), nil)
+		if err != nil {
+			return err
+		}
+		name := kind
+		switch kind {
+		case "settings":
+			if resBytes, err = stripSettings(resBytes); err != nil {
+				return err
+			}
+		case "alias":
+			name = "aliases"
+		}
+		if err := os.WriteFile(base+"."+name+".json", resBytes, 0644); err != nil {
+			return err
+		}
+	}
+	if dataStream := c.info.dataStreams[index]; dataStream != "" {
+		b, _ := json.Marshal(map[string]string{"data_stream": dataStream})
+		if err := os.WriteFile(base+".data_stream.json", b, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveClusterMetadata writes the ingest pipelines and the templates of the cluster. the ones a
+// cluster doesn't have, like component templates before 7.8, are skipped
+func saveClusterMetadata(c *esClient, base string) error {
+	for _, m := range clusterMetadata {
+		resBytes, err := c.do("GET", m.path, nil)
+		if err != nil {
+			if strings.Contains(err.Error(), "404 Not Found") || strings.Contains(err.Error(), "405 Method Not Allowed") {
+				log.Warnf("Skipping %s, the cluster doesn't have them", m.name)
+				continue
+			}
+			return err
+		}
+		if err := os.WriteFile(base+"."+m.name+".json", resBytes, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreClusterMetadata creates the pipelines and templates saved in dir. the built-in ones,
+// whose names start with a dot, belong to the target cluster and are left alone
+func restoreClusterMetadata(c *esClient, dir string) int {
+	failed := 0
+	for _, m := range clusterMetadata {
+		files, _ := filepath.Glob(filepath.Join(dir, "*."+m.name+".json"))
+		for _, file := range files {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				log.Error(err)
+				failed++
+				continue
+			}
+			objects := map[string]string{}
+			switch m.name {
+			case "index_templates", "component_templates":
+				// {"index_templates":[{"name":"x","index_template":{...}}]}
+				gjson.GetBytes(b, m.name).ForEach(func(_, t gjson.Result) bool {
+					objects[t.Get("name").String()] = t.Get(strings.TrimSuffix(m.name, "s")).Raw
+					return true
+				})
+			default:
+				// {"x":{...}}
+				gjson.ParseBytes(b).ForEach(func(name, body gjson.Result) bool {
+					objects[name.String()] = body.Raw
+					return true
+				})
+			}
+			for name, body := range objects {
+				if strings.HasPrefix(name, ".") {
+					continue
+				}
+				if _, err := c.do("PUT", m.path+"/"+url.PathEscape(name), []byte(body)); err != nil {
+					log.Errorf("Could not restore %s %s: %s", strings.TrimSuffix(m.name, "s"), name, err)
+					failed++
+					continue
+				}
+				log.Infof("Restored %s %s", strings.TrimSuffix(m.name, "s"), name)
+			}
+		}
+	}
+	return failed
+}
+
+// stripSettings removes nonPortableSettings from a _settings response
+func stripSettings(resBytes []byte) ([]byte, error) {
+	var indices map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(resBytes, &indices); err != nil {
+		return nil, err
+	}
+	for _, index := range indices {
+		if s, ok := index["settings"]; ok {
+			p, err := portableSettings(s)
+			if err != nil {
+				return nil, err
+			}
+			index["settings"] = p
+		}
+	}
+	return json.Marshal(indices)
+}
+
+// portableSettings removes nonPortableSettings from the settings of an index
+func portableSettings(settings []byte) ([]byte, error) {
+	var s map[string]interface{}
+	if err := json.Unmarshal(settings, &s); err != nil {
+		return nil, err
+	}
+	if index, ok := s["index"].(map[string]interface{}); ok {
+		for _, name := range nonPortableSettings {
+			deleteSetting(index, strings.Split(name, "."))
+		}
+	}
+	return json.Marshal(s)
+}
+
+func deleteSetting(m map[string]interface{}, path []string) {
+	if len(path) == 1 {
+		delete(m, path[0])
+		return
+	}
+	if sub, ok := m[path[0]].(map[string]interface{}); ok {
+		deleteSetting(sub, path[1:])
+		if len(sub) == 0 {
+			delete(m, path[0])
+		}
+	}
+}
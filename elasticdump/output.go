@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tidwall/gjson"
+)
+
+var outputFormat = flag.String("outputFormat", "doc", `Format of each line in the dump: "doc" for {"_index","_id","_source"}, "source" for only _source, or "bulk" for _bulk API action and source lines. "parquet" writes a Parquet file with a column for each field of the mappings instead`)
+
+func checkOutputFormat() error {
+	switch *outputFormat {
+	case "doc", "source", "bulk", "parquet":
+		return nil
+	}
+	return fmt.Errorf("unknown -outputFormat %s", *outputFormat)
+}
+
+// bulkType is the _type of the bulk actions of index, from the mappings saved next to its dump.
+// it's empty unless the cluster has typed mappings, which need it to take the dump back
+func bulkType(c *esClient, index, base string) string {
+	if *outputFormat != "bulk" {
+		return ""
+	}
+	mapping, _ := os.ReadFile(base + ".mapping.json")
+	return c.info.docType(gjson.GetBytes(mapping, gjson.Escape(index)+".mappings").Raw)
+}
+
+// writeHits writes each hit of a search response page as NDJSON, in the -outputFormat format.
+// docType is the _type of bulk actions
+func writeHits(w io.Writer, hits gjson.Result, docType string) error {
+	var err error
+	hits.ForEach(func(_, hit gjson.Result) bool {
+		// _source comes back the way it was indexed, which can span several lines
+		source := hit.Get("_source|@ugly").Raw
+		if source == "" {
+			source = "{}"
+		}
+		switch *outputFormat {
+		case "source":
+			_, err = fmt.Fprintf(w, "%s\n", source)
+		case "doc":
+			_, err = fmt.Fprintf(w, "{%s%s}\n", hitMeta(hit, false), `"_source":`+source)
+		case "bulk":
+			meta := hitMeta(hit, true)
+			if docType != "" {
+				k, _ := json.Marshal(docType)
+				meta += `"_type":` + string(k)
+			}
+			_, err = fmt.Fprintf(w, "{\"index\":{%s}}\n%s\n", trimComma(meta), source)
+		}
+		return err == nil
+	})
+	return err
+}
+
+// hitMeta returns the _index, _id and _routing of a hit as JSON object members, each followed by a
+// comma. bulk actions call _routing just routing
+func hitMeta(hit gjson.Result, bulk bool) string {
+	var meta string
+	for _, key := range []string{"_index", "_id", "_routing"} {
+		if v := hit.Get(key); v.Exists() {
+			name := key
+			if bulk && key == "_routing" {
+				name = "routing"
+			}
+			k, _ := json.Marshal(name)
+			meta += string(k) + ":" + v.Raw + ","
+		}
+	}
+	return meta
+}
+
+func trimComma(s string) string {
+	if len(s) > 0 && s[len(s)-1] == ',' {
+		return s[:len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+var parquetRowGroupMB = flag.Int64("parquetRowGroupMB", 64, "Size of the row groups of -outputFormat parquet. Rows are kept in memory until a row group is full")
+
+// the kinds of Parquet columns, every mapping type ends up as one of them
+const (
+	kindString = "string"
+	kindInt    = "int"
+	kindDouble = "double"
+	kindBool   = "bool"
+	kindJSON   = "json"
+)
+
+// the column of the fields in _source that have no column of their own, or whose values don't
+// fit in theirs, as a JSON object of the dotted names to the values
+const unmappedColumn = "_unmapped"
+
+var mappingKinds = map[string]string{
+	"keyword": kindString, "constant_keyword": kindString, "wildcard": kindString, "text": kindString,
+	"match_only_text": kindString, "search_as_you_type": kindString, "ip": kindString, "version": kindString,
+	"date": kindString, "date_nanos": kindString,
+	"long": kindInt, "integer": kindInt, "short": kindInt, "byte": kindInt,
+	"double": kindDouble, "float": kindDouble, "half_float": kindDouble, "scaled_float": kindDouble,
+	"boolean": kindBool,
+}
+
+var parquetTypes = map[string]string{
+	kindString: "type=BYTE_ARRAY, convertedtype=UTF8",
+	kindJSON:   "type=BYTE_ARRAY, convertedtype=UTF8",
+	kindInt:    "type=INT64",
+	kindDouble: "type=DOUBLE",
+	kindBool:   "type=BOOLEAN",
+}
+
+var parquetCodecs = map[string]parquet.CompressionCodec{
+	"none": parquet.CompressionCodec_UNCOMPRESSED,
+	"gzip": parquet.CompressionCodec_GZIP,
+	"zstd": parquet.CompressionCodec_ZSTD,
+}
+
+type parquetColumn struct {
+	name string
+	kind string
+}
+
+// parquetSchema returns the columns of the mappings of an index, with the fields of objects
+// flattened into dotted names. nested fields, objects that aren't indexed and the types with
+// no Parquet equivalent, like geo_point, are JSON strings. so is a field with different types
+// in the type names of a mapping from before Elasticsearch 7
+func parquetSchema(mappings gjson.Result) []parquetColumn {
+	kinds := map[string]string{}
+	var walk func(prefix string, properties gjson.Result)
+	walk = func(prefix string, properties gjson.Result) {
+		properties.ForEach(func(key, field gjson.Result) bool {
+			name := prefix + key.String()
+			typ := field.Get("type").String()
+			switch {
+			case typ == "alias":
+				// aliases aren't in _source
+				return true
+			case (typ == "" || typ == "object") && field.Get("properties").Exists() && field.Get("enabled").String() != "false":
+				walk(name+".", field.Get("properties"))
+				return true
+			}
+			kind, ok := mappingKinds[typ]
+			if !ok {
+				kind = kindJSON
+			}
+			if existing, ok := kinds[name]; ok && existing != kind {
+				kind = kindJSON
+			}
+			kinds[name] = kind
+			return true
+		})
+	}
+	if properties := mappings.Get("properties"); properties.Exists() {
+		walk("", properties)
+	} else {
+		mappings.ForEach(func(_, typed gjson.Result) bool {
+			walk("", typed.Get("properties"))
+			return true
+		})
+	}
+
+	columns := []parquetColumn{{"_index", kindString}, {"_id", kindString}, {"_routing", kindString}}
+	names := make([]string, 0, len(kinds))
+	for name := range kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		columns = append(columns, parquetColumn{name, kinds[name]})
+	}
+	return append(columns, parquetColumn{unmappedColumn, kindJSON})
+}
+
+// parquetWriter writes the pages of an index as rows of a Parquet file. the rows are written in
+// row groups of -parquetRowGroupMB as they come, only the current row group is in memory
+type parquetWriter struct {
+	cp      *checkpoint
+	path    string
+	columns []parquetColumn
+	// byName is the position of each column, objects is every dotted name with columns under it
+	byName  map[string]int
+	objects map[string]bool
+	file    source.ParquetFile
+	pw      *writer.JSONWriter
+}
+
+func openParquet(base string, cp *checkpoint) (*parquetWriter, error) {
+	mapping, err := os.ReadFile(base + ".mapping.json")
+	if err != nil {
+		return nil, err
+	}
+	w := &parquetWriter{
+		cp:      cp,
+		path:    base + ".parquet",
+		columns: parquetSchema(gjson.GetBytes(mapping, gjson.Escape(cp.Index)+".mappings")),
+		byName:  map[string]int{},
+		objects: map[string]bool{},
+	}
+	fields := make([]map[string]string, len(w.columns))
+	for i, column := range w.columns {
+		w.byName[column.name] = i
+		for j := strings.LastIndexByte(column.name, '.'); j > 0; j = strings.LastIndexByte(column.name[:j], '.') {
+			w.objects[column.name[:j]] = true
+		}
+		// the schema tags are split on commas
+		name := strings.NewReplacer(",", "_", "=", "_").Replace(column.name)
+		fields[i] = map[string]string{"Tag": fmt.Sprintf("name=%s, inname=C%d, %s, repetitiontype=OPTIONAL", name, i, parquetTypes[column.kind])}
+	}
+	schema, _ := json.Marshal(map[string]interface{}{
+		"Tag":    "name=parquet_go_root, repetitiontype=REQUIRED",
+		"Fields": fields,
+	})
+
+	w.file, err = local.NewLocalFileWriter(w.path)
+	if err != nil {
+		return nil, err
+	}
+	w.pw, err = writer.NewJSONWriter(string(schema), w.file, 4)
+	if err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	w.pw.RowGroupSize = *parquetRowGroupMB << 20
+	w.pw.CompressionType = parquetCodecs[cp.Compress]
+	cp.Parts = []partCheckpoint{{File: filepath.Base(w.path)}}
+	return w, nil
+}
+
+func (w *parquetWriter) writePage(hits gjson.Result) error {
+	var err error
+	hits.ForEach(func(_, hit gjson.Result) bool {
+		var row []byte
+		row, err = json.Marshal(w.row(hit))
+		if err != nil {
+			return false
+		}
+		err = w.pw.Write(string(row))
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	part := &w.cp.Parts[0]
+	part.Docs += int64(len(hits.Array()))
+	if info, err := os.Stat(w.path); err == nil {
+		part.Bytes = info.Size()
+	}
+	return nil
+}
+
+// row turns a hit into a row of the JSON writer, by the inname of each column
+func (w *parquetWriter) row(hit gjson.Result) map[string]interface{} {
+	row := map[string]interface{}{}
+	for _, meta := range []string{"_index", "_id", "_routing"} {
+		if v := hit.Get(meta); v.Exists() {
+			row[fmt.Sprintf("C%d", w.byName[meta])] = v.String()
+		}
+	}
+	unmapped := map[string]json.RawMessage{}
+	var walk func(prefix string, object gjson.Result)
+	walk = func(prefix string, object gjson.Result) {
+		object.ForEach(func(key, value gjson.Result) bool {
+			name := prefix + key.String()
+			if i, ok := w.byName[name]; ok && name != unmappedColumn {
+				if v, ok := columnValue(w.columns[i].kind, value); ok {
+					row[fmt.Sprintf("C%d", i)] = v
+					return true
+				}
+			} else if value.IsObject() && w.objects[name] {
+				walk(name+".", value)
+				return true
+			}
+			unmapped[name] = json.RawMessage(value.Raw)
+			return true
+		})
+	}
+	walk("", hit.Get("_source"))
+	if len(unmapped) != 0 {
+		b, _ := json.Marshal(unmapped)
+		row[fmt.Sprintf("C%d", w.byName[unmappedColumn])] = string(b)
+	}
+	return row
+}
+
+// columnValue converts a value of _source to the kind of its column. ok is false when it doesn't
+// fit, like an array of numbers in an integer column
+func columnValue(kind string, value gjson.Result) (interface{}, bool) {
+	if value.Type == gjson.Null {
+		return nil, true
+	}
+	if kind == kindJSON {
+		return value.Raw, true
+	}
+	// every field can have an array of values, only one value fits a column
+	if value.IsArray() {
+		values := value.Array()
+		if len(values) != 1 {
+			if kind == kindString {
+				return value.Raw, true
+			}
+			return nil, false
+		}
+		value = values[0]
+	}
+	switch kind {
+	case kindString:
+		if value.Type == gjson.String {
+			return value.String(), true
+		}
+		return value.Raw, true
+	case kindInt:
+		i, err := strconv.ParseInt(strings.TrimSpace(value.String()), 10, 64)
+		return i, err == nil && (value.Type == gjson.Number || value.Type == gjson.String)
+	case kindDouble:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value.String()), 64)
+		return f, err == nil && (value.Type == gjson.Number || value.Type == gjson.String)
+	case kindBool:
+		switch {
+		case value.Type == gjson.True || value.Type == gjson.False:
+			return value.Bool(), true
+		case value.Type == gjson.String && (value.Str == "true" || value.Str == "false"):
+			return value.Str == "true", true
+		}
+	}
+	return nil, false
+}
+
+// Close writes the last row group and the footer, what's written is a valid file even when the
+// dump failed
+func (w *parquetWriter) Close() error {
+	if err := w.pw.WriteStop(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if info, err := os.Stat(w.path); err == nil {
+		w.cp.Parts[0].Bytes = info.Size()
+	}
+	return nil
+}
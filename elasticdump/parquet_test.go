@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tidwall/gjson"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestParquetRoundTrip(t *testing.T) {
+	setFlag(t, "outputFormat", "parquet")
+	setFlag(t, "compress", "zstd")
+	dir := t.TempDir()
+	base := filepath.Join(dir, "ESDUMP-fake-logs-2024-01-01T00:00:00Z")
+	mapping := `{"logs":{"mappings":{"properties":{
+		"n":{"type":"long"},"msg":{"type":"text"},"ok":{"type":"boolean"},"score":{"type":"float"},
+		"host":{"properties":{"name":{"type":"keyword"}}},"loc":{"type":"geo_point"}}}}}`
+	if err := os.WriteFile(base+".mapping.json", []byte(mapping), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cp := newCheckpoint("logs", base, 1)
+	w, err := openDump(base, cp, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := gjson.Parse(`[
+		{"_index":"logs","_id":"1","_routing":"r1","_source":{"n":1,"msg":"hello","ok":true,"score":1.5,"host":{"name":"web01"},"loc":{"lat":1.5,"lon":2},"extra":"x"}},
+		{"_index":"logs","_id":"2","_source":{"n":[1,2],"ok":"false","host":{"name":"web02","ip":"10.0.0.1"}}}
+	]`)
+	if err := w.writePage(page); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(base + ".parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cp.Parts) != 1 || cp.Parts[0].Docs != 2 || cp.Parts[0].Bytes != info.Size() {
+		t.Errorf("checkpoint parts are %+v, want 2 documents in %d bytes", cp.Parts, info.Size())
+	}
+
+	fr, err := local.NewLocalFileReader(base + ".parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fr.Close()
+	pr, err := reader.NewParquetReader(fr, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+
+	// the columns are in the order of parquetSchema, named after the fields. the reader returns
+	// the rows as structs, with a field for each column named after its InName
+	var names []string
+	fields := map[string]string{}
+	for i := 1; i < len(pr.SchemaHandler.Infos); i++ {
+		names = append(names, pr.SchemaHandler.GetExName(i))
+		fields[pr.SchemaHandler.GetExName(i)] = pr.SchemaHandler.GetInName(i)
+	}
+	want := []string{"_index", "_id", "_routing", "host.name", "loc", "msg", "n", "ok", "score", unmappedColumn}
+	if len(names) != len(want) {
+		t.Fatalf("columns are %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("columns are %v, want %v", names, want)
+		}
+	}
+
+	rows, err := pr.ReadByNumber(int(pr.GetNumRows()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(rows)
+	got := gjson.ParseBytes(b).Array()
+	if len(got) != 2 {
+		t.Fatalf("read %d rows, want 2: %s", len(got), b)
+	}
+	// the values by column, JSON null when they're empty
+	for i, tc := range []struct {
+		row     int
+		column  string
+		want    string
+		jsonMap bool
+	}{
+		{0, "_routing", `"r1"`, false},
+		{0, "host.name", `"web01"`, false},
+		{0, "loc", `"{\"lat\":1.5,\"lon\":2}"`, false},
+		{0, "msg", `"hello"`, false},
+		{0, "n", `1`, false},
+		{0, "ok", `true`, false},
+		{0, "score", `1.5`, false},
+		{0, unmappedColumn, `{"extra":"x"}`, true},
+		{1, "_routing", `null`, false},
+		{1, "msg", `null`, false},
+		// a value that doesn't fit its column goes to _unmapped, a string that does is converted
+		{1, "n", `null`, false},
+		{1, "ok", `false`, false},
+		{1, unmappedColumn, `{"host.ip":"10.0.0.1","n":[1,2]}`, true},
+	} {
+		value := got[tc.row].Get(fields[tc.column])
+		raw := value.Raw
+		if raw == "" {
+			raw = "null"
+		}
+		if tc.jsonMap {
+			raw = value.String()
+		}
+		if !jsonEqual(raw, tc.want) {
+			t.Errorf("%d: row %d %s is %s, want %s", i, tc.row, tc.column, raw, tc.want)
+		}
+	}
+}
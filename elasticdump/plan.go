@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var plan = flag.Bool("plan", false, "List the indices of the cluster, what the filters make of them and the estimated size of the dump, then exit without downloading")
+var planFormat = flag.String("planFormat", "table", "Format of -plan: table or json")
+
+func checkPlanFlags() error {
+	switch *planFormat {
+	case "table", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown -planFormat %s", *planFormat)
+}
+
+// dumpPlan is what -plan prints as JSON
+type dumpPlan struct {
+	Endpoint        string           `json:"endpoint"`
+	ClusterName     string           `json:"cluster_name,omitempty"`
+	Version         string           `json:"version,omitempty"`
+	Distribution    string           `json:"distribution,omitempty"`
+	Indices         []indexCandidate `json:"indices"`
+	Selected        int              `json:"selected"`
+	Docs            int64            `json:"docs"`
+	EstimatedSizeKB int64            `json:"estimated_size_kb"`
+}
+
+// printPlan writes the plan of a dump of indices to w. the estimate is the primary store size of
+// the selected indices, scaled down by the documents matching -query, -from and -to when they're
+// set. the dump itself is usually in that range before compression
+func printPlan(w io.Writer, c *esClient, indices []indexCandidate) error {
+	sort.Slice(indices, func(i, j int) bool {
+		return indices[i].Index < indices[j].Index
+	})
+	p := dumpPlan{
+		Endpoint:     c.endpoint,
+		ClusterName:  c.info.Name,
+		Version:      c.info.Version,
+		Distribution: c.info.Flavor,
+		Indices:      indices,
+	}
+	for i := range p.Indices {
+		index := &p.Indices[i]
+		if !index.Selected {
+			continue
+		}
+		docs, size := index.DocsCount, index.PriStoreSizeKB
+		if searchQuery != nil {
+			matching, err := countDocs(c, index.Index)
+			if err != nil {
+				log.Warnf("Could not count the matching documents of %s: %s", index.Index, err)
+			} else {
+				index.MatchingDocs = &matching
+				if docs != 0 {
+					size = size * matching / docs
+				}
+				docs = matching
+			}
+		}
+		p.Selected++
+		p.Docs += docs
+		p.EstimatedSizeKB += size
+	}
+
+	if *planFormat == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(p)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	header := "INDEX\tDOCS\tSIZE\tPRI SIZE\tDOCS OK\tSIZE OK\tREGEX OK\tEXCLUDED\tSELECTED"
+	if searchQuery != nil {
+		header += "\tMATCHING"
+	}
+	fmt.Fprintln(tw, header)
+	for _, index := range p.Indices {
+		name := index.Index
+		if index.DataStream != "" {
+			name += " (" + index.DataStream + ")"
+		}
+		selected := "yes"
+		if !index.Selected {
+			selected = "no: " + index.Reason
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s", name, index.DocsCount, formatKB(index.StoreSizeKB), formatKB(index.PriStoreSizeKB),
+			yesNo(index.DocCountOK), yesNo(index.SizeOK), yesNo(index.RegexOK), yesNo(index.Excluded), selected)
+		if index.MatchingDocs != nil {
+			fmt.Fprintf(tw, "\t%d", *index.MatchingDocs)
+		}
+		fmt.Fprintln(tw)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%s %s %s: %d of %d indices selected, %d documents, about %s\n",
+		p.Distribution, p.Version, p.Endpoint, p.Selected, len(p.Indices), p.Docs, formatKB(p.EstimatedSizeKB))
+	return err
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func formatKB(kb int64) string {
+	size := float64(kb)
+	for _, unit := range []string{"KB", "MB", "GB", "TB"} {
+		if size < 1024 || unit == "TB" {
+			return fmt.Sprintf("%.1f%s", size, unit)
+		}
+		size /= 1024
+	}
+	return ""
+}
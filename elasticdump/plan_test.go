@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// planCluster is a fakeCluster with an index for every reason -plan has to skip one
+func planCluster(t *testing.T) (*fakeCluster, *esClient) {
+	t.Helper()
+	f, c := newFakeCluster(t, "logs-1", 250)
+	f.cat = `[
+		{"health":"green","status":"open","index":"logs-1","docs.count":"1000","store.size":"2048","pri.store.size":"1024"},
+		{"health":"green","status":"open","index":"logs-small","docs.count":"10","store.size":"4096","pri.store.size":"2048"},
+		{"health":"green","status":"open","index":"logs-tiny","docs.count":"500","store.size":"100","pri.store.size":"50"},
+		{"health":"green","status":"open","index":".kibana_1","docs.count":"500","store.size":"2048","pri.store.size":"1024"},
+		{"health":"green","status":"open","index":"secret","docs.count":"500","store.size":"2048","pri.store.size":"1024"},
+		{"health":"green","status":"open","index":"metrics-1","docs.count":"500","store.size":"2048","pri.store.size":"1024"},
+		{"health":"green","status":"open","index":"logs-old","docs.count":"500","store.size":"2048","pri.store.size":"1024"},
+		{"status":"close","index":"logs-closed"},
+		{"health":"green","status":"open","index":".ds-app-2024.01.01-000001","docs.count":"300","store.size":"4096","pri.store.size":"2048"}
+	]`
+	f.hidden = map[string]bool{".kibana_1": true, "secret": true, ".ds-app-2024.01.01-000001": true}
+	f.dataStreams = `{"data_streams":[{"name":"logs-app","indices":[{"index_name":".ds-app-2024.01.01-000001"}]}]}`
+	return f, c
+}
+
+func TestListIndices(t *testing.T) {
+	_, c := planCluster(t)
+	indices := listIndices(c, 100, 1024, regexp.MustCompile("^logs-"), regexp.MustCompile("-old$"))
+	want := map[string]string{
+		"logs-1":      "",
+		"logs-small":  "below -minDocCount or -minIndexSizeKB",
+		"logs-tiny":   "below -minDocCount or -minIndexSizeKB",
+		".kibana_1":   "hidden or system index",
+		"secret":      "hidden or system index",
+		"metrics-1":   "doesn't match -indexRegex",
+		"logs-old":    "matches -excludeRegex",
+		"logs-closed": "closed",
+		// a backing index is dumped like any index, and matches by its data stream
+		".ds-app-2024.01.01-000001": "",
+	}
+	if len(indices) != len(want) {
+		t.Errorf("got %d indices, want %d", len(indices), len(want))
+	}
+	for _, index := range indices {
+		reason, ok := want[index.Index]
+		if !ok {
+			t.Errorf("unexpected index %s", index.Index)
+			continue
+		}
+		if index.Reason != reason || index.Selected != (reason == "") {
+			t.Errorf("%s is selected %v because %q, want %q", index.Index, index.Selected, index.Reason, reason)
+		}
+	}
+	if got := getIndexList(c, 100, 1024, regexp.MustCompile("^logs-"), regexp.MustCompile("-old$")); strings.Join(got, ",") != "logs-1,.ds-app-2024.01.01-000001" {
+		t.Errorf("index list is %v", got)
+	}
+}
+
+func TestPrintPlan(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		query string
+		docs  int64
+		// the primary store size of the selected indices, scaled by the matching documents of
+		// logs-1 with a -query. the count of the backing index fails, it's taken whole
+		sizeKB int64
+	}{
+		{name: "all documents", docs: 1300, sizeKB: 1024 + 2048},
+		{name: "query", query: "level:error", docs: 250 + 300, sizeKB: 256 + 2048},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setQueryFlags(t, map[string]string{"query": tc.query})
+			setFlag(t, "planFormat", "json")
+			_, c := planCluster(t)
+			indices := listIndices(c, 100, 1024, regexp.MustCompile("^logs-"), nil)
+			var out bytes.Buffer
+			if err := printPlan(&out, c, indices); err != nil {
+				t.Fatal(err)
+			}
+			var p dumpPlan
+			if err := json.Unmarshal(out.Bytes(), &p); err != nil {
+				t.Fatalf("%s: %s", err, out.String())
+			}
+			if p.Selected != 3 || p.Docs != tc.docs+500 || p.EstimatedSizeKB != tc.sizeKB+1024 {
+				t.Errorf("plan has %d indices, %d documents and %dKB, want 3, %d and %dKB", p.Selected, p.Docs, p.EstimatedSizeKB, tc.docs+500, tc.sizeKB+1024)
+			}
+			for _, index := range p.Indices {
+				if (index.MatchingDocs != nil) != (tc.query != "" && index.Index == "logs-1") {
+					t.Errorf("%s has matching documents %v", index.Index, index.MatchingDocs)
+				}
+			}
+
+			setFlag(t, "planFormat", "table")
+			out.Reset()
+			if err := printPlan(&out, c, indices); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out.String(), "3 of 9 indices selected") || !strings.Contains(out.String(), "logs-old") {
+				t.Errorf("table plan is\n%s", out.String())
+			}
+		})
+	}
+}
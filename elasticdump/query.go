@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+var query = flag.String("query", "", `Only dump the documents matching a Lucene query, e.g. 'host.name:web01 AND event.code:4625', or a query DSL object. "@file.json" reads the query DSL from a file`)
+var timeField = flag.String("timeField", "@timestamp", "Field -from and -to apply to")
+var from = flag.String("from", "", "Only dump documents with -timeField at or after this time, e.g. 2024-01-01T00:00:00Z or now-7d")
+var to = flag.String("to", "", "Only dump documents with -timeField at or before this time, e.g. now")
+var sourceIncludes = flag.String("sourceIncludes", "", "Comma separated fields of _source to keep, wildcards work, e.g. @timestamp,host.*")
+var sourceExcludes = flag.String("sourceExcludes", "", "Comma separated fields of _source to leave out")
+
+// searchQuery and searchSource are what -query, -from, -to and the source flags add to every
+// search, set by checkQueryFlags
+var searchQuery json.RawMessage
+var searchSource json.RawMessage
+
+func checkQueryFlags() error {
+	var filters []json.RawMessage
+	q := strings.TrimSpace(*query)
+	if strings.HasPrefix(q, "@") {
+		b, err := os.ReadFile(q[1:])
+		if err != nil {
+			return err
+		}
+		q = strings.TrimSpace(string(b))
+	}
+	switch {
+	case q == "":
+	case strings.HasPrefix(q, "{"):
+		if !json.Valid([]byte(q)) {
+			return fmt.Errorf("-query is not valid JSON")
+		}
+		// both a whole search body and only its query work
+		if inner := gjson.Get(q, "query"); inner.IsObject() {
+			q = inner.Raw
+		}
+		// Marshal compacts it and escapes &, < and > the way the checkpoint saves it, so a
+		// -resume compares the same bytes
+		b, err := json.Marshal(json.RawMessage(q))
+		if err != nil {
+			return err
+		}
+		filters = append(filters, b)
+	default:
+		b, _ := json.Marshal(map[string]interface{}{"query_string": map[string]string{"query": q}})
+		filters = append(filters, b)
+	}
+	if *from != "" || *to != "" {
+		bounds := map[string]string{}
+		if *from != "" {
+			bounds["gte"] = *from
+		}
+		if *to != "" {
+			bounds["lte"] = *to
+		}
+		b, _ := json.Marshal(map[string]interface{}{"range": map[string]interface{}{*timeField: bounds}})
+		filters = append(filters, b)
+	}
+	switch len(filters) {
+	case 0:
+		searchQuery = nil
+	case 1:
+		searchQuery = filters[0]
+	default:
+		searchQuery, _ = json.Marshal(map[string]interface{}{"bool": map[string]interface{}{"filter": filters}})
+	}
+
+	searchSource = nil
+	if *sourceIncludes != "" || *sourceExcludes != "" {
+		source := map[string][]string{}
+		if *sourceIncludes != "" {
+			source["includes"] = splitFields(*sourceIncludes)
+		}
+		if *sourceExcludes != "" {
+			source["excludes"] = splitFields(*sourceExcludes)
+		}
+		searchSource, _ = json.Marshal(source)
+	}
+	return nil
+}
+
+func splitFields(s string) []string {
+	var fields []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// searchBody adds the query and _source filtering of the flags to the body of a search
+func searchBody(body map[string]interface{}) map[string]interface{} {
+	if searchQuery != nil {
+		body["query"] = searchQuery
+	}
+	if searchSource != nil {
+		body["_source"] = searchSource
+	}
+	return body
+}
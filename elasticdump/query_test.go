@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// setQueryFlags sets the query flags for the rest of the test, and searchQuery and searchSource
+// from them
+func setQueryFlags(t *testing.T, flags map[string]string) {
+	t.Helper()
+	// cleanups run last in first out, this one once the flags are back
+	t.Cleanup(func() { checkQueryFlags() })
+	for name, value := range flags {
+		setFlag(t, name, value)
+	}
+	if err := checkQueryFlags(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		flags  map[string]string
+		query  string
+		source string
+	}{
+		{name: "none", flags: map[string]string{}},
+		{
+			name:  "lucene",
+			flags: map[string]string{"query": "host.name:web01 AND event.code:4625"},
+			query: `{"query_string":{"query":"host.name:web01 AND event.code:4625"}}`,
+		},
+		{
+			name:  "query DSL",
+			flags: map[string]string{"query": `{ "term": { "host.name": "web01" } }`},
+			query: `{"term":{"host.name":"web01"}}`,
+		},
+		{
+			name:  "search body",
+			flags: map[string]string{"query": `{"query": {"term": {"host.name": "web01"}}, "size": 5}`},
+			query: `{"term":{"host.name":"web01"}}`,
+		},
+		{
+			name:  "time range",
+			flags: map[string]string{"from": "now-7d", "to": "now", "timeField": "ts"},
+			query: `{"range":{"ts":{"gte":"now-7d","lte":"now"}}}`,
+		},
+		{
+			name:  "query and time range",
+			flags: map[string]string{"query": `{"match_all":{}}`, "from": "2024-01-01T00:00:00Z"},
+			query: `{"bool":{"filter":[{"match_all":{}},{"range":{"@timestamp":{"gte":"2024-01-01T00:00:00Z"}}}]}}`,
+		},
+		{
+			name:   "source filter",
+			flags:  map[string]string{"sourceIncludes": "@timestamp, host.*", "sourceExcludes": "message"},
+			source: `{"excludes":["message"],"includes":["@timestamp","host.*"]}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setQueryFlags(t, tc.flags)
+			if got := gjson.ParseBytes(searchQuery); !jsonEqual(got.Raw, tc.query) {
+				t.Errorf("query is %s, want %s", searchQuery, tc.query)
+			}
+			if got := gjson.ParseBytes(searchSource); !jsonEqual(got.Raw, tc.source) {
+				t.Errorf("_source is %s, want %s", searchSource, tc.source)
+			}
+		})
+	}
+}
+
+// jsonEqual compares two JSON values, or two empty strings
+func jsonEqual(a, b string) bool {
+	if a == "" || b == "" {
+		return a == b
+	}
+	var va, vb interface{}
+	json.Unmarshal([]byte(a), &va)
+	json.Unmarshal([]byte(b), &vb)
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return string(ja) == string(jb)
+}
+
+func TestResumeWithQuery(t *testing.T) {
+	setFlag(t, "outputDir", t.TempDir())
+	setFlag(t, "paging", "pit")
+	setFlag(t, "pageSize", "4")
+	setFlag(t, "resume", "true")
+	// the checkpoint escapes &, < and >, a resume has to see the same query
+	setQueryFlags(t, map[string]string{"query": `{"query_string":{"query":"a && b or n:<5"}}`, "sourceIncludes": "n"})
+	f, c := newFakeCluster(t, "logs", 25)
+	failedDump(t, f, c)
+
+	cp, err := indexToJSON(c, "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cp.Done || f.pitSeq != 1 {
+		t.Errorf("dump done %v, opened %d Points-in-Time, want it resumed", cp.Done, f.pitSeq)
+	}
+	for _, search := range f.searches {
+		if q := gjson.Get(search, "query.query_string.query").String(); q != "a && b or n:<5" {
+			t.Errorf("search %s doesn't have the -query", search)
+		}
+		if gjson.Get(search, "_source.includes.0").String() != "n" {
+			t.Errorf("search %s doesn't have the _source filter", search)
+		}
+	}
+
+	// a different query doesn't mix its documents into the dump
+	setQueryFlags(t, map[string]string{"query": "n:1"})
+	cp.Done = false
+	if err := cp.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := indexToJSON(c, "logs"); err == nil {
+		t.Error("resumed a dump with a different -query")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tidwall/gjson"
+)
+
+var restoreInput = flag.String("input", ".", "restore: a dump file, or a directory of dumps")
+var bulkSize = flag.Int("bulkSize", 1000, "restore: documents in each _bulk request")
+var restoreMetadata = flag.Bool("restoreMetadata", true, "restore: create each index with the mappings, settings and aliases saved next to its dump, and the pipelines and templates of the dumps")
+var renameIndex renameRules
+
+func init() {
+	flag.Var(&renameIndex, "renameIndex", "restore: rename indices with a regex, as pattern=replacement, e.g. ^logs-(.*)=restored-$1. Can be repeated, the rules are applied in order")
+}
+
+// renameRules are the -renameIndex flags
+type renameRules []renameRule
+
+type renameRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+func (r *renameRules) String() string {
+	var rules []string
+	for _, rule := range *r {
+		rules = append(rules, rule.re.String()+"="+rule.replacement)
+	}
+	return strings.Join(rules, ",")
+}
+
+func (r *renameRules) Set(s string) error {
+	pattern, replacement, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("%s is not pattern=replacement", s)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, renameRule{re: re, replacement: replacement})
+	return nil
+}
+
+func (r renameRules) apply(index string) string {
+	for _, rule := range r {
+		index = rule.re.ReplaceAllString(index, rule.replacement)
+	}
+	return index
+}
+
+// restore bulk-indexes every dump in -input into c, and returns the number of documents that
+// failed
+func restore(c *esClient) int {
+	files := []string{*restoreInput}
+	if info, err := os.Stat(*restoreInput); err == nil && info.IsDir() {
+		files = nil
+		for _, ext := range compressExt {
+			matches, err := filepath.Glob(filepath.Join(*restoreInput, "*.ndjson"+ext))
+			check(err)
+			files = append(files, matches...)
+		}
+	}
+	if len(files) == 0 {
+		log.Warnf("No dumps found in %s", *restoreInput)
+		return 0
+	}
+	// the parts of a dump are restored one after the other, in order
+	sort.Strings(files)
+	dumps := map[string][]string{}
+	for _, file := range files {
+		base := dumpBase(file)
+		dumps[base] = append(dumps[base], file)
+	}
+	failed := 0
+	if *restoreMetadata {
+		failed += restoreClusterMetadata(c, filepath.Dir(files[0]))
+	}
+	done := make(chan int)
+	// at most -concurrency dumps are restored at once, like they're dumped
+	slots := make(chan struct{}, *concurrency)
+	for base, parts := range dumps {
+		go func(base string, parts []string) {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			log.Infof("Restoring %s to %s", base, c.endpoint)
+			restoreDump(c, base, parts, done)
+		}(base, parts)
+	}
+	for range dumps {
+		failed += <-done
+	}
+	return failed
+}
+
+// restoreDump restores the parts of one dump, in any -outputFormat and compression, and sends
+// the number of documents that failed to done
+func restoreDump(c *esClient, base string, parts []string, done chan<- int) {
+	failed := 0
+	defer func() {
+		done <- failed
+	}()
+	mapping, _ := os.ReadFile(base + ".mapping.json")
+	settings, _ := os.ReadFile(base + ".settings.json")
+	aliases, _ := os.ReadFile(base + ".aliases.json")
+	dataStream, _ := os.ReadFile(base + ".data_stream.json")
+
+	// the dump's index comes from its sidecar files, or from the _index of each document
+	var index string
+	gjson.ParseBytes(mapping).ForEach(func(key, _ gjson.Result) bool {
+		index = key.String()
+		return false
+	})
+	mappings := gjson.GetBytes(mapping, gjson.Escape(index)+".mappings").Raw
+	docType := c.info.docType(mappings)
+	// a backing index is restored into its data stream, which its index template creates.
+	// data streams only take the create action
+	op := "index"
+	stream := gjson.GetBytes(dataStream, "data_stream").String()
+	if stream != "" {
+		op = "create"
+	} else if index != "" && *restoreMetadata {
+		key := gjson.Escape(index)
+		if err := createIndex(c, renameIndex.apply(index), map[string]string{
+			"mappings": c.info.adaptMappings(mappings, docType),
+			"settings": gjson.GetBytes(settings, key+".settings").Raw,
+			"aliases":  gjson.GetBytes(aliases, key+".aliases").Raw,
+		}); err != nil {
+			log.Errorf("Could not create index %s: %s", renameIndex.apply(index), err)
+			failed = 1
+			return
+		}
+	}
+
+	var body bytes.Buffer
+	docs, sent := 0, 0
+	flush := func() {
+		if docs == 0 {
+			return
+		}
+		failed += sendBulk(c, body.Bytes(), docs)
+		sent += docs
+		body.Reset()
+		docs = 0
+	}
+	for _, path := range parts {
+		part, err := openPart(path)
+		if err != nil {
+			log.Error(err)
+			failed++
+			continue
+		}
+		r := bufio.NewReader(part)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) != 0 {
+				doc := gjson.ParseBytes(line)
+				var action map[string]interface{}
+				var source string
+				switch {
+				case doc.Get("index").IsObject() && len(doc.Map()) == 1:
+					// bulk format, the source is on the next line
+					json.Unmarshal([]byte(doc.Get("index").Raw), &action)
+					next, nextErr := r.ReadBytes('\n')
+					source = string(bytes.TrimSpace(next))
+					if source == "" {
+						log.Errorf("%s: bulk action without a source line", path)
+						failed++
+						action = nil
+					}
+					err = nextErr
+				case doc.Get("_source").Exists():
+					action = map[string]interface{}{}
+					for key, name := range map[string]string{"_index": "_index", "_id": "_id", "_routing": "routing"} {
+						if v := doc.Get(key); v.Exists() {
+							action[name] = v.Value()
+						}
+					}
+					source = doc.Get("_source").Raw
+				default:
+					action = map[string]interface{}{}
+					source = string(bytes.TrimSpace(line))
+				}
+				if action != nil {
+					target, _ := action["_index"].(string)
+					if target == "" {
+						target = index
+					}
+					if stream != "" {
+						target = stream
+					}
+					delete(action, "_type")
+					if docType != "" {
+						action["_type"] = docType
+					}
+					if target == "" {
+						log.Errorf("%s: no index for the document, the dump has neither _index nor a .mapping.json sidecar", path)
+						failed++
+					} else {
+						action["_index"] = renameIndex.apply(target)
+						meta, _ := json.Marshal(map[string]interface{}{op: action})
+						body.Write(meta)
+						body.WriteByte('\n')
+						body.WriteString(source)
+						body.WriteByte('\n')
+						docs++
+						if docs >= *bulkSize {
+							flush()
+						}
+					}
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Errorf("%s: %s", path, err)
+				failed++
+				break
+			}
+		}
+		part.Close()
+	}
+	flush()
+	log.Infof("Sent %d documents from %s, %d failed", sent, base, failed)
+}
+
+// createIndex creates index with the mappings, settings and aliases of a dump. an index that
+// already exists is left as it is
+func createIndex(c *esClient, index string, metadata map[string]string) error {
+	body := map[string]json.RawMessage{}
+	for key, value := range metadata {
+		if value == "" {
+			continue
+		}
+		// older dumps have all the settings, newer ones are stripped at dump time already
+		if key == "settings" {
+			s, err := portableSettings([]byte(value))
+			if err != nil {
+				return err
+			}
+			value = string(s)
+		}
+		body[key] = json.RawMessage(value)
+	}
+	postData, _ := json.Marshal(body)
+	_, err := c.do("PUT", "/"+url.PathEscape(index), postData)
+	if err != nil && strings.Contains(err.Error(), "resource_already_exists_exception") {
+		log.Warnf("Index %s already exists, restoring into it as it is", index)
+		return nil
+	}
+	return err
+}
+
+// sendBulk sends one _bulk request of docs documents and returns how many of them failed
+func sendBulk(c *esClient, body []byte, docs int) int {
+	resBytes, err := c.do("POST", "/_bulk", body)
+	if err != nil {
+		log.Errorf("Bulk request failed: %s", err)
+		return docs
+	}
+	if !gjson.GetBytes(resBytes, "errors").Bool() {
+		return 0
+	}
+	failed := 0
+	gjson.GetBytes(resBytes, "items").ForEach(func(_, item gjson.Result) bool {
+		item.ForEach(func(_, result gjson.Result) bool {
+			if e := result.Get("error"); e.Exists() {
+				if failed == 0 {
+					log.Errorf("Document %s in %s failed: %s", result.Get("_id"), result.Get("_index"), e.Get("reason"))
+				}
+				failed++
+			}
+			return false
+		})
+		return true
+	})
+	return failed
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tidwall/gjson"
+)
+
+var paging = flag.String("paging", "auto", `How to page through an index: "pit" for Point-in-Time with search_after, "scroll", or "auto" to use pit on Elasticsearch 7.12 and later and scroll otherwise`)
+var slices = flag.Int("slices", 1, "Number of parallel workers for each index, each one reads a slice of it")
+var concurrency = flag.Int("concurrency", 4, "Number of indices dumped, or dumps restored, at the same time")
+var pageSize = flag.Int("pageSize", 1000, "Documents in each page of a search")
+var keepAlive = flag.Duration("keepAlive", 10*time.Minute, "How long the cluster keeps a Point-in-Time or scroll between pages. A Point-in-Time that's still open when a dump is resumed lets it continue from the exact position")
+
+func checkPagingFlags() error {
+	switch *paging {
+	case "auto", "pit", "scroll":
+	default:
+		return fmt.Errorf("unknown -paging %s", *paging)
+	}
+	if *slices < 1 {
+		return fmt.Errorf("-slices must be at least 1")
+	}
+	if *concurrency < 1 {
+		return fmt.Errorf("-concurrency must be at least 1")
+	}
+	if *pageSize < 1 {
+		return fmt.Errorf("-pageSize must be at least 1")
+	}
+	if *keepAlive < time.Second {
+		return fmt.Errorf("-keepAlive must be at least 1s")
+	}
+	return nil
+}
+
+// keepAliveString is -keepAlive the way the cluster takes it
+func keepAliveString() string {
+	return fmt.Sprintf("%ds", int(keepAlive.Seconds()))
+}
+
+// pageFunc gets each page of hits of a slice, along with the sort values to search after it and
+// the id of the Point-in-Time it came from, which can change between pages
+type pageFunc func(slice int, hits gjson.Result, after json.RawMessage, pit string) error
+
+// dumpIndex reads every document of index that isn't in cp yet, with a worker for each slice
+// of cp, and passes each page of hits to write. write is called by one worker at a time, and cp
+// is saved after it. cp isn't marked Done, that waits for the dump file to be closed
+func dumpIndex(c *esClient, index string, cp *checkpoint, write func(hits gjson.Result) error) error {
+	var pit string
+	// the search_after values of a Point-in-Time only mean something in that Point-in-Time
+	reuse := false
+	if usePIT(c) && pitOpen(c, cp.PIT) {
+		pit, reuse = cp.PIT, true
+		log.Infof("Resuming %s from its Point-in-Time", index)
+	}
+	if !reuse && started(cp) {
+		return fmt.Errorf("the Point-in-Time of %s is gone, the slices can't continue where they stopped", index)
+	}
+	if usePIT(c) && pit == "" {
+		var err error
+		pit, err = openPIT(c, index)
+		if err != nil {
+			if *paging == "pit" {
+				return err
+			}
+			log.Warnf("Point-in-Time isn't available for %s, using scroll: %s", index, err)
+		}
+	}
+	cp.PIT = pit
+
+	var lock sync.Mutex
+	page := func(slice int, hits gjson.Result, after json.RawMessage, id string) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if err := write(hits); err != nil {
+			return err
+		}
+		// a resume checks the newest id, the first one can be gone by then
+		if id != "" {
+			cp.PIT = id
+		}
+		n := int64(len(hits.Array()))
+		cp.Slices[slice].Docs += n
+		cp.Slices[slice].SearchAfter = after
+		cp.Docs += n
+		return cp.save()
+	}
+	errs := make(chan error, len(cp.Slices))
+	running := 0
+	for slice := range cp.Slices {
+		if !reuse {
+			cp.Slices[slice].SearchAfter = nil
+		}
+		sc := cp.Slices[slice]
+		if sc.Done {
+			continue
+		}
+		running++
+		after := sc.SearchAfter
+		go func(slice int) {
+			var err error
+			if pit != "" {
+				err = searchAfter(c, pit, slice, len(cp.Slices), after, page)
+			} else {
+				err = scroll(c, index, slice, len(cp.Slices), page)
+			}
+			if err == nil {
+				lock.Lock()
+				cp.Slices[slice].Done = true
+				err = cp.save()
+				lock.Unlock()
+			} else {
+				log.Errorf("Error while reading slice %d of %s: %s", slice, index, err)
+			}
+			errs <- err
+		}(slice)
+	}
+	var failed error
+	for i := 0; i < running; i++ {
+		if err := <-errs; err != nil {
+			failed = err
+		}
+	}
+	if failed != nil {
+		// the Point-in-Time is left open for -resume, it expires after -keepAlive
+		return failed
+	}
+	if cp.PIT != "" {
+		closePIT(c, cp.PIT)
+		cp.PIT = ""
+	}
+	return cp.save()
+}
+
+// usePIT is whether the dumps page through a Point-in-Time rather than a scroll
+func usePIT(c *esClient) bool {
+	return *paging == "pit" || (*paging == "auto" && c.info.pit())
+}
+
+// started is whether a slice of cp that isn't done has documents already. such a slice can only
+// continue in the Point-in-Time it was reading: a new search or a scroll doesn't return the
+// documents in the same order, so the ones already written can't be told apart
+func started(cp *checkpoint) bool {
+	for _, sc := range cp.Slices {
+		if !sc.Done && sc.Docs != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// pitOpen is whether the Point-in-Time pit can still be searched
+func pitOpen(c *esClient, pit string) bool {
+	if pit == "" {
+		return false
+	}
+	_, err := c.do("POST", "/_search", pitQuery(pit, 0))
+	return err == nil
+}
+
+// sliceQuery adds the slice of the worker to a search body when there's more than one
+func sliceQuery(body map[string]interface{}, slice, max int) map[string]interface{} {
+	if max > 1 {
+		body["slice"] = map[string]int{"id": slice, "max": max}
+	}
+	return body
+}
+
+func openPIT(c *esClient, index string) (string, error) {
+	resBytes, err := c.do("POST", fmt.Sprintf("/%v/_pit?keep_alive=%v", url.PathEscape(index), keepAliveString()), nil)
+	if err != nil {
+		return "", err
+	}
+	id := gjson.GetBytes(resBytes, "id").String()
+	if id == "" {
+		return "", fmt.Errorf("no Point-in-Time id in %s", resBytes)
+	}
+	return id, nil
+}
+
+func closePIT(c *esClient, pit string) {
+	postData, _ := json.Marshal(map[string]string{"id": pit})
+	if _, err := c.do("DELETE", "/_pit", postData); err != nil {
+		log.Warnf("Could not close Point-in-Time: %s", err)
+	}
+}
+
+func pitQuery(pit string, size int) []byte {
+	postData, _ := json.Marshal(map[string]interface{}{
+		"size": size,
+		"pit":  map[string]string{"id": pit, "keep_alive": keepAliveString()},
+	})
+	return postData
+}
+
+// searchAfter pages through a Point-in-Time in the order of _shard_doc, the cheapest sort there is
+func searchAfter(c *esClient, pit string, slice, max int, after json.RawMessage, page pageFunc) error {
+	for {
+		body := sliceQuery(searchBody(map[string]interface{}{
+			"size":             *pageSize,
+			"pit":              map[string]string{"id": pit, "keep_alive": keepAliveString()},
+			"sort":             []string{"_shard_doc"},
+			"track_total_hits": false,
+		}), slice, max)
+		if after != nil {
+			body["search_after"] = after
+		}
+		postData, _ := json.Marshal(body)
+		resBytes, err := c.do("POST", "/_search", postData)
+		if err != nil {
+			return err
+		}
+		hits := gjson.GetBytes(resBytes, "hits.hits")
+		n := len(hits.Array())
+		if n == 0 {
+			return nil
+		}
+		// the id can change between pages
+		if id := gjson.GetBytes(resBytes, "pit_id").String(); id != "" {
+			pit = id
+		}
+		after = json.RawMessage(hits.Get(fmt.Sprintf("%d.sort", n-1)).Raw)
+		if err := page(slice, hits, after, pit); err != nil {
+			return err
+		}
+		if n < *pageSize {
+			return nil
+		}
+	}
+}
+
+// scroll pages through index with a scroll, and clears it when it's done. a scroll can't be
+// resumed
+func scroll(c *esClient, index string, slice, max int, page pageFunc) error {
+	postData, _ := json.Marshal(sliceQuery(searchBody(map[string]interface{}{
+		"size": *pageSize,
+		"sort": []string{"_doc"},
+	}), slice, max))
+	resBytes, err := c.do("POST", fmt.Sprintf("/%v/_search?scroll=%v", url.PathEscape(index), keepAliveString()), postData)
+	var scrollIDs []string
+	defer func() {
+		clearScroll(c, scrollIDs)
+	}()
+	for {
+		if err != nil {
+			return err
+		}
+		id := gjson.GetBytes(resBytes, "_scroll_id").String()
+		if id != "" && (len(scrollIDs) == 0 || scrollIDs[len(scrollIDs)-1] != id) {
+			scrollIDs = append(scrollIDs, id)
+		}
+		hits := gjson.GetBytes(resBytes, "hits.hits")
+		if len(hits.Array()) == 0 {
+			return nil
+		}
+		if err := page(slice, hits, nil, ""); err != nil {
+			return err
+		}
+		if id == "" {
+			return nil
+		}
+		postData, _ := json.Marshal(map[string]string{"scroll_id": id, "scroll": keepAliveString()})
+		resBytes, err = c.do("POST", "/_search/scroll", postData)
+	}
+}
+
+func clearScroll(c *esClient, scrollIDs []string) {
+	if len(scrollIDs) == 0 {
+		return
+	}
+	postData, _ := json.Marshal(map[string][]string{"scroll_id": scrollIDs})
+	if _, err := c.do("DELETE", "/_search/scroll", postData); err != nil && !strings.Contains(err.Error(), "404 Not Found") {
+		log.Warnf("Could not clear scroll: %s", err)
+	}
+}
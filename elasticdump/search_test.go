@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// fakeCluster answers the requests a dump of one index makes, the way Elasticsearch 8 does. the
+// documents are {"n":0} to {"n":docs-1}, with their number as _id and _shard_doc sort value
+type fakeCluster struct {
+	lock  sync.Mutex
+	index string
+	docs  int
+	// failAfter makes every search fail once this many pages were returned, 0 never does
+	failAfter int
+	pages     int
+	pits      map[string]bool
+	pitSeq    int
+	// rotatePIT gives every page of a Point-in-Time a new id and retires the one it was searched
+	// with, for dumps with one slice. lastPIT is the newest one
+	rotatePIT bool
+	lastPIT   string
+	scrolls   map[string]*fakeScroll
+	scrollSeq int
+	// searches are the bodies of the searches that returned documents, apart from the next pages
+	// of a scroll
+	searches []string
+	// cat is the _cat/indices response, the hidden indices aren't in it without
+	// expand_wildcards=all
+	cat    string
+	hidden map[string]bool
+	// dataStreams is the _data_stream response
+	dataStreams string
+}
+
+type fakeScroll struct {
+	left []int
+	size int
+}
+
+// newFakeCluster starts a fakeCluster and returns a client for it
+func newFakeCluster(t *testing.T, index string, docs int) (*fakeCluster, *esClient) {
+	t.Helper()
+	f := &fakeCluster{index: index, docs: docs, pits: map[string]bool{}, scrolls: map[string]*fakeScroll{}, cat: "[]", dataStreams: `{"data_streams":[]}`}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	c := &esClient{
+		endpoint: srv.URL,
+		host:     "fake",
+		http:     srv.Client(),
+		info:     clusterInfo{Name: "fake", Flavor: "elasticsearch", Version: "8.11.1", Major: 8, Minor: 11},
+	}
+	return f, c
+}
+
+func (f *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	index := "/" + f.index
+	switch {
+	case r.Method == "GET" && r.URL.Path == index+"/_mapping":
+		fmt.Fprintf(w, `{%q:{"mappings":{"properties":{"n":{"type":"long"}}}}}`, f.index)
+	case r.Method == "GET" && r.URL.Path == index+"/_settings":
+		fmt.Fprintf(w, `{%q:{"settings":{"index":{"number_of_shards":"1","uuid":"U1"}}}}`, f.index)
+	case r.Method == "GET" && r.URL.Path == index+"/_alias":
+		fmt.Fprintf(w, `{%q:{"aliases":{}}}`, f.index)
+	case r.Method == "GET" && r.URL.Path == "/_cat/indices":
+		var cat []string
+		gjson.Parse(f.cat).ForEach(func(_, index gjson.Result) bool {
+			if r.URL.Query().Get("expand_wildcards") == "all" || !f.hidden[index.Get("index").String()] {
+				cat = append(cat, index.Raw)
+			}
+			return true
+		})
+		io.WriteString(w, "["+strings.Join(cat, ",")+"]")
+	case r.Method == "GET" && r.URL.Path == "/_data_stream":
+		io.WriteString(w, f.dataStreams)
+	case r.Method == "POST" && r.URL.Path == index+"/_pit":
+		f.pitSeq++
+		id := fmt.Sprintf("pit-%d", f.pitSeq)
+		f.pits[id] = true
+		fmt.Fprintf(w, `{"id":%q}`, id)
+	case r.Method == "DELETE" && r.URL.Path == "/_pit":
+		delete(f.pits, gjson.GetBytes(body, "id").String())
+		io.WriteString(w, `{"succeeded":true}`)
+	case r.Method == "POST" && r.URL.Path == "/_search":
+		id := gjson.GetBytes(body, "pit.id").String()
+		if !f.pits[id] {
+			http.Error(w, `{"error":{"type":"search_context_missing_exception"}}`, http.StatusNotFound)
+			return
+		}
+		size := int(gjson.GetBytes(body, "size").Int())
+		after := int64(-1)
+		if a := gjson.GetBytes(body, "search_after.0"); a.Exists() {
+			after = a.Int()
+		}
+		var nums []int
+		for _, n := range f.slice(body) {
+			if int64(n) > after && len(nums) < size {
+				nums = append(nums, n)
+			}
+		}
+		if f.rotatePIT && len(nums) != 0 && !f.failing() {
+			delete(f.pits, id)
+			id = fmt.Sprintf("%s.%d", strings.SplitN(id, ".", 2)[0], f.pages+1)
+			f.pits[id] = true
+			f.lastPIT = id
+		}
+		f.page(w, body, nums, fmt.Sprintf(`"pit_id":%q`, id))
+	case r.Method == "POST" && r.URL.Path == index+"/_search" && r.URL.Query().Get("scroll") != "":
+		f.scrollSeq++
+		id := fmt.Sprintf("scroll-%d", f.scrollSeq)
+		s := &fakeScroll{left: f.slice(body), size: int(gjson.GetBytes(body, "size").Int())}
+		f.scrolls[id] = s
+		f.scrollPage(w, body, id, s)
+	case r.Method == "POST" && r.URL.Path == index+"/_search":
+		// a count
+		fmt.Fprintf(w, `{"hits":{"total":{"value":%d,"relation":"eq"},"hits":[]}}`, f.docs)
+	case r.Method == "POST" && r.URL.Path == "/_search/scroll":
+		id := gjson.GetBytes(body, "scroll_id").String()
+		s, ok := f.scrolls[id]
+		if !ok {
+			http.Error(w, `{"error":{"type":"search_context_missing_exception"}}`, http.StatusNotFound)
+			return
+		}
+		f.scrollPage(w, body, id, s)
+	case r.Method == "DELETE" && r.URL.Path == "/_search/scroll":
+		gjson.GetBytes(body, "scroll_id").ForEach(func(_, id gjson.Result) bool {
+			delete(f.scrolls, id.String())
+			return true
+		})
+		io.WriteString(w, `{"succeeded":true}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// slice returns the documents of the slice a search asks for, all of them without a slice
+func (f *fakeCluster) slice(body []byte) []int {
+	id, max := gjson.GetBytes(body, "slice.id").Int(), gjson.GetBytes(body, "slice.max").Int()
+	var nums []int
+	for n := 0; n < f.docs; n++ {
+		if max == 0 || int64(n)%max == id {
+			nums = append(nums, n)
+		}
+	}
+	return nums
+}
+
+func (f *fakeCluster) scrollPage(w http.ResponseWriter, body []byte, id string, s *fakeScroll) {
+	n := s.size
+	if n > len(s.left) {
+		n = len(s.left)
+	}
+	nums := s.left[:n]
+	s.left = s.left[n:]
+	f.page(w, body, nums, fmt.Sprintf(`"_scroll_id":%q`, id))
+}
+
+// failing is whether searches fail by now
+func (f *fakeCluster) failing() bool {
+	return f.failAfter != 0 && f.pages >= f.failAfter
+}
+
+// page writes a search response with the documents nums, or fails it after failAfter pages
+func (f *fakeCluster) page(w http.ResponseWriter, body []byte, nums []int, id string) {
+	if f.failing() {
+		http.Error(w, `{"error":{"type":"circuit_breaking_exception"}}`, http.StatusTooManyRequests)
+		return
+	}
+	if len(nums) != 0 {
+		f.pages++
+		if !gjson.GetBytes(body, "scroll_id").Exists() {
+			f.searches = append(f.searches, string(body))
+		}
+	}
+	hits := make([]string, len(nums))
+	for i, n := range nums {
+		hits[i] = fmt.Sprintf(`{"_index":%q,"_id":"%d","_score":null,"_source":{"n":%d},"sort":[%d]}`, f.index, n, n, n)
+	}
+	fmt.Fprintf(w, `{%s,"hits":{"total":{"value":%d,"relation":"eq"},"hits":[%s]}}`, id, len(nums), strings.Join(hits, ","))
+}
+
+// setFlag sets a flag for the rest of the test
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	old := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set(name, old) })
+}
+
+// docNumbers returns the "n" of each hit, sorted
+func docNumbers(hits []gjson.Result) []int {
+	nums := make([]int, len(hits))
+	for i, hit := range hits {
+		nums[i] = int(hit.Get("_source.n").Int())
+	}
+	sort.Ints(nums)
+	return nums
+}
+
+// wantNumbers checks that nums is 0 to docs-1, every document once
+func wantNumbers(t *testing.T, nums []int, docs int) {
+	t.Helper()
+	if len(nums) != docs {
+		t.Errorf("got %d documents, want %d", len(nums), docs)
+	}
+	for i, n := range nums {
+		if n != i {
+			t.Errorf("document %d is missing or repeated, got %v", i, nums)
+			return
+		}
+	}
+}
+
+func TestDumpIndexPaging(t *testing.T) {
+	for _, tc := range []struct {
+		paging string
+		slices int
+		// minor is the Elasticsearch 7 minor version, 0 is Elasticsearch 8
+		minor   int
+		wantPIT bool
+	}{
+		{paging: "pit", slices: 1, wantPIT: true},
+		{paging: "pit", slices: 3, wantPIT: true},
+		{paging: "scroll", slices: 1},
+		{paging: "scroll", slices: 3},
+		{paging: "auto", slices: 2, wantPIT: true},
+		// Point-in-Time with _shard_doc came with 7.12
+		{paging: "auto", slices: 2, minor: 10},
+	} {
+		name := fmt.Sprintf("%s/%d slices", tc.paging, tc.slices)
+		if tc.minor != 0 {
+			name += fmt.Sprintf("/7.%d", tc.minor)
+		}
+		t.Run(name, func(t *testing.T) {
+			setFlag(t, "paging", tc.paging)
+			setFlag(t, "pageSize", "4")
+			f, c := newFakeCluster(t, "logs", 25)
+			if tc.minor != 0 {
+				c.info.Version, c.info.Major, c.info.Minor = "7."+strconv.Itoa(tc.minor)+".0", 7, tc.minor
+			}
+			cp := newCheckpoint("logs", t.TempDir()+"/dump", tc.slices)
+			var hits []gjson.Result
+			write := func(page gjson.Result) error {
+				hits = append(hits, page.Array()...)
+				return nil
+			}
+			if err := dumpIndex(c, "logs", cp, write); err != nil {
+				t.Fatal(err)
+			}
+
+			wantNumbers(t, docNumbers(hits), 25)
+			if cp.Docs != 25 {
+				t.Errorf("checkpoint has %d documents, want 25", cp.Docs)
+			}
+			var sliceDocs int64
+			for i, sc := range cp.Slices {
+				if !sc.Done {
+					t.Errorf("slice %d isn't done", i)
+				}
+				sliceDocs += sc.Docs
+			}
+			if sliceDocs != 25 {
+				t.Errorf("the slices have %d documents, want 25", sliceDocs)
+			}
+			if cp.PIT != "" || len(f.pits) != 0 || len(f.scrolls) != 0 {
+				t.Errorf("Point-in-Time %q, %d open and %d scrolls left after the dump", cp.PIT, len(f.pits), len(f.scrolls))
+			}
+			if (f.pitSeq != 0) != tc.wantPIT {
+				t.Errorf("opened %d Points-in-Time, want them: %v", f.pitSeq, tc.wantPIT)
+			}
+			for _, search := range f.searches {
+				var body map[string]json.RawMessage
+				json.Unmarshal([]byte(search), &body)
+				if _, ok := body["slice"]; ok != (tc.slices > 1) {
+					t.Errorf("search %s, want a slice with %d slices", search, tc.slices)
+				}
+			}
+		})
+	}
+}
+
+func TestDumpIndexStopsAtError(t *testing.T) {
+	setFlag(t, "paging", "pit")
+	setFlag(t, "pageSize", "4")
+	f, c := newFakeCluster(t, "logs", 25)
+	f.failAfter = 3
+	cp := newCheckpoint("logs", t.TempDir()+"/dump", 1)
+	var hits []gjson.Result
+	err := dumpIndex(c, "logs", cp, func(page gjson.Result) error {
+		hits = append(hits, page.Array()...)
+		return nil
+	})
+	if err == nil {
+		t.Fatal("no error from a dump whose searches fail")
+	}
+	// the pages before the error are written and checkpointed, the Point-in-Time stays open
+	if len(hits) != 12 || cp.Docs != 12 || cp.Slices[0].Done {
+		t.Errorf("wrote %d documents, checkpointed %d, slice done %v, want 12 and not done", len(hits), cp.Docs, cp.Slices[0].Done)
+	}
+	if after := gjson.GetBytes(cp.Slices[0].SearchAfter, "0").Int(); after != 11 {
+		t.Errorf("slice resumes after %d, want 11", after)
+	}
+	if cp.PIT == "" || !f.pits[cp.PIT] {
+		t.Errorf("Point-in-Time %q isn't left open for -resume", cp.PIT)
+	}
+}
+
+func TestResumeFromNewPointInTimeID(t *testing.T) {
+	setFlag(t, "outputDir", t.TempDir())
+	setFlag(t, "paging", "pit")
+	setFlag(t, "pageSize", "4")
+	setFlag(t, "resume", "true")
+	f, c := newFakeCluster(t, "logs", 25)
+	f.rotatePIT = true
+	cp := failedDump(t, f, c)
+	if cp.PIT != f.lastPIT {
+		t.Errorf("checkpoint has Point-in-Time %s, want the newest id %s", cp.PIT, f.lastPIT)
+	}
+
+	cp, err := indexToJSON(c, "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cp.Done || f.pitSeq != 1 {
+		t.Errorf("dump done %v, opened %d Points-in-Time, want it resumed from the first one", cp.Done, f.pitSeq)
+	}
+	wantNumbers(t, docNumbers(readDump(t, filepath.Join(*outputDir, c.host), cp)), 25)
+	if len(f.pits) != 0 {
+		t.Errorf("%d Point-in-Time ids left open, want the newest one closed", len(f.pits))
+	}
+}
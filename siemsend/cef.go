@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// cefMapping describes how a JSON event is turned into a CEF or LEEF message. vendor, product and
+// version are fixed strings, the *_field entries and the extensions are JSON field paths
+type cefMapping struct {
+	Vendor          string `json:"vendor"`
+	Product         string `json:"product"`
+	Version         string `json:"version"`
+	EventIDField    string `json:"event_id_field"`
+	NameField       string `json:"name_field"`
+	SeverityField   string `json:"severity_field"`
+	DefaultEventID  string `json:"default_event_id"`
+	DefaultName     string `json:"default_name"`
+	DefaultSeverity string `json:"default_severity"`
+	// Extensions maps CEF/LEEF keys, like src or suser, to the JSON field holding their value
+	Extensions map[string]string `json:"extensions"`
+}
+
+func loadCEFMapping(path string) (*cefMapping, error) {
+	m := &cefMapping{
+		Vendor:          "siemsend",
+		Product:         "siemsend",
+		Version:         "1.0",
+		DefaultEventID:  "0",
+		DefaultName:     "event",
+		DefaultSeverity: "5",
+	}
+	if path == "" {
+		return m, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+func (m *cefMapping) field(event map[string]interface{}, path, def string) string {
+	if path == "" {
+		return def
+	}
+	if v := getFieldString(event, path); v != "" {
+		return v
+	}
+	return def
+}
+
+// extensionKeys returns the extension keys in a stable order
+func (m *cefMapping) extensionKeys() []string {
+	keys := make([]string, 0, len(m.Extensions))
+	for k := range m.Extensions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+var cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+
+// CEF formats an event as ArcSight Common Event Format:
+// CEF:0|Vendor|Product|Version|EventClassID|Name|Severity|key=value key=value
+func (m *cefMapping) CEF(event map[string]interface{}) string {
+	var b strings.Builder
+	b.WriteString("CEF:0")
+	for _, h := range []string{
+		m.Vendor, m.Product, m.Version,
+		m.field(event, m.EventIDField, m.DefaultEventID),
+		m.field(event, m.NameField, m.DefaultName),
+		m.field(event, m.SeverityField, m.DefaultSeverity),
+	} {
+		b.WriteByte('|')
+		b.WriteString(cefHeaderEscaper.Replace(h))
+	}
+	b.WriteByte('|')
+	first := true
+	for _, k := range m.extensionKeys() {
+		v := getFieldString(event, m.Extensions[k])
+		if v == "" {
+			continue
+		}
+		if !first {
+			b.WriteByte(' ')
+		}
+		first = false
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(cefExtensionEscaper.Replace(v))
+	}
+	return b.String()
+}
+
+var leefEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+// LEEF formats an event as IBM QRadar LEEF 1.0, attributes separated by tabs:
+// LEEF:1.0|Vendor|Product|Version|EventID|key=value	key=value
+func (m *cefMapping) LEEF(event map[string]interface{}) string {
+	var b strings.Builder
+	b.WriteString("LEEF:1.0")
+	for _, h := range []string{
+		m.Vendor, m.Product, m.Version,
+		m.field(event, m.EventIDField, m.DefaultEventID),
+	} {
+		b.WriteByte('|')
+		b.WriteString(strings.ReplaceAll(leefEscaper.Replace(h), "|", " "))
+	}
+	b.WriteByte('|')
+	attrs := []string{}
+	if sev := m.field(event, m.SeverityField, ""); sev != "" {
+		attrs = append(attrs, "sev="+leefEscaper.Replace(sev))
+	}
+	for _, k := range m.extensionKeys() {
+		if v := getFieldString(event, m.Extensions[k]); v != "" {
+			attrs = append(attrs, k+"="+leefEscaper.Replace(v))
+		}
+	}
+	b.WriteString(strings.Join(attrs, "\t"))
+	return b.String()
+}
+
+var cefExtensionUnescaper = strings.NewReplacer(`\\`, `\`, `\=`, `=`, `\n`, "\n", `\r`, "\r")
+
+// parseCEF decodes a CEF message, with or without a syslog header in front of it. the header
+// fields get their own keys and the extensions are kept under "extensions" by their CEF key
+func parseCEF(line string) (map[string]interface{}, error) {
+	start := strings.Index(line, "CEF:")
+	if start == -1 {
+		return nil, fmt.Errorf("not a CEF message")
+	}
+	line = line[start+len("CEF:"):]
+
+	// the header is 7 fields separated by unescaped pipes, the rest of the line is the extension
+	var header []string
+	var field strings.Builder
+	i := 0
+	for ; i < len(line) && len(header) < 7; i++ {
+		switch c := line[i]; {
+		case c == '\\' && i+1 < len(line) && (line[i+1] == '|' || line[i+1] == '\\'):
+			i++
+			field.WriteByte(line[i])
+		case c == '|':
+			header = append(header, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(c)
+		}
+	}
+	if len(header) < 7 {
+		return nil, fmt.Errorf("CEF header has %d fields, 7 expected", len(header))
+	}
+	event := map[string]interface{}{
+		"cef_version":    header[0],
+		"device_vendor":  header[1],
+		"device_product": header[2],
+		"device_version": header[3],
+		"signature_id":   header[4],
+		"name":           header[5],
+		"severity":       header[6],
+	}
+	extensions, err := parseCEFExtensions(line[i:])
+	if err != nil {
+		return nil, err
+	}
+	if len(extensions) != 0 {
+		event["extensions"] = extensions
+	}
+	return event, nil
+}
+
+// parseCEFExtensions splits key=value pairs. values can have spaces in them, so a value runs
+// until the next unescaped "key=" that follows a space
+func parseCEFExtensions(s string) (map[string]interface{}, error) {
+	extensions := make(map[string]interface{})
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return extensions, nil
+	}
+	// positions of the unescaped equal signs
+	var eqs []int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '=':
+			eqs = append(eqs, i)
+		}
+	}
+	if len(eqs) == 0 {
+		return nil, fmt.Errorf("invalid CEF extension %q", s)
+	}
+	keyStart := 0
+	for n, eq := range eqs {
+		key := s[keyStart:eq]
+		if key == "" || strings.ContainsAny(key, " \\") {
+			return nil, fmt.Errorf("invalid CEF extension key %q", key)
+		}
+		valueEnd := len(s)
+		if n+1 < len(eqs) {
+			// the next key starts after the last space before the next equal sign
+			space := strings.LastIndexByte(s[eq+1:eqs[n+1]], ' ')
+			if space == -1 {
+				return nil, fmt.Errorf("invalid CEF extension value for %s", key)
+			}
+			valueEnd = eq + 1 + space
+			keyStart = valueEnd + 1
+		}
+		extensions[key] = cefExtensionUnescaper.Replace(strings.TrimRight(s[eq+1:valueEnd], " "))
+	}
+	return extensions, nil
+}
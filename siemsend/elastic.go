@@ -1,12 +1,10 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
-	"crypto/tls"
+	"fmt"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
@@ -14,12 +12,26 @@ import (
 	"github.com/elastic/go-elasticsearch/v8/esutil"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 type elastic struct {
-	Endpoint string
-	Index    string
-	Compress bool
+	Endpoint   []string
+	Index      string
+	Compress   bool
+	Username   string
+	Password   string
+	APIKey     string
+	TLS        tlsOptions
+	Pipeline   string
+	DataStream bool
+	IndexField string
+	bi         esutil.BulkIndexer
+	config     esutil.BulkIndexerConfig
+	// stats adds up the bulk indexers closed by Flush
+	stats  esutil.BulkIndexerStats
+	failed *failedLines
+	errors *bulkErrors
 }
 
 var _ = elastic{}.init()
@@ -31,131 +43,195 @@ func (s elastic) init() error {
 		Long:  `make sure your data is in jsonl format, meaning each line is a separate json object.`,
 		Args:  cobra.ExactArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
-			s.Send(cmd, args)
+			runOutput(&s)
 		},
 	}
-	flags := ElasticCmd.Flags()
-	flags.StringVarP(&s.Endpoint, "endpoint", "", "", "endpoint")
-	flags.StringVarP(&s.Index, "index", "", "", "index")
-	flags.BoolVarP(&s.Compress, "compress", "", false, "compress")
+	s.flags(ElasticCmd.Flags())
+	outputs["elastic"] = func(flags *pflag.FlagSet) GenericOutput {
+		o := &elastic{}
+		o.flags(flags)
+		return o
+	}
 
 	rootCmd.AddCommand(ElasticCmd)
 	return nil
 }
 
-func (s elastic) Send(cmd *cobra.Command, args []string) {
-	// tr := &http.Transport{
-	// 	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	// }
-	// httpClient := &http.Client{Transport: tr}
+func (s *elastic) flags(flags *pflag.FlagSet) {
+	flags.StringSliceVarP(&s.Endpoint, "endpoint", "", []string{}, "endpoint, can be repeated")
+	flags.StringVarP(&s.IndexField, "index-field", "", "", "JSON field that overrides --index per event, e.g. one set by a transform route")
+	flags.StringVarP(&s.Index, "index", "", "", "index, or data stream with --data-stream")
+	flags.BoolVarP(&s.Compress, "compress", "", false, "compress")
+	flags.StringVarP(&s.Username, "username", "", "", "username for basic auth")
+	flags.StringVarP(&s.Password, "password", "", "", "password for basic auth")
+	flags.StringVarP(&s.APIKey, "api-key", "", "", "base64 encoded API key, takes precedence over username and password")
+	s.TLS.flags(flags)
+	flags.StringVarP(&s.Pipeline, "pipeline", "", "", "ingest pipeline to run the documents through")
+	flags.BoolVarP(&s.DataStream, "data-stream", "", false, "--index is a data stream: documents are sent with op_type=create and the index is never created")
+}
+
+func (s *elastic) spoolKey() string {
+	return spoolKey(append(append([]string{}, s.Endpoint...), s.Index)...)
+}
 
+func (s *elastic) Init() error {
+	tlsConfig, err := s.TLS.Config()
+	if err != nil {
+		return err
+	}
 	cfg := elasticsearch.Config{
-		Addresses: []string{
-			s.Endpoint,
-		},
+		Addresses: s.Endpoint,
+		Username:  s.Username,
+		Password:  s.Password,
+		APIKey:    s.APIKey,
 		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			TLSClientConfig: tlsConfig,
 		}, CompressRequestBody: s.Compress,
+		RetryOnStatus: []int{429, 502, 503, 504},
+		MaxRetries:    int(globalSpool.Retries),
+		RetryBackoff:  globalSpool.backoff,
 	}
 
 	client, err := elasticsearch.NewClient(cfg)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	// ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	// defer cancel()
-
 	ctx := context.Background()
 
-	// Use the IndexExists service to check if a specified index exists.
-	exists, err := esapi.IndicesExistsRequest{
-		Index: []string{s.Index},
-	}.Do(ctx, client)
+	// data streams are created by their index template on the first write. without --index every
+	// document goes to its --index-field, and those indices are created as they're written to
+	if !s.DataStream && s.Index != "" {
+		// Use the IndexExists service to check if a specified index exists.
+		exists, err := esapi.IndicesExistsRequest{
+			Index: []string{s.Index},
+		}.Do(ctx, client)
 
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if exists.IsError() {
-		// Create a new index.
-		// createIndex := esapi.IndicesCreate{
-		// 	Index: s.Index,
-		// }.Do(ctx, client)
-
-		createIndex, err := client.Indices.Create(
-			s.Index,
-			client.Indices.Create.WithBody(nil),
-		)
-
-		// createIndex, err := client.Indices.Create(s.Index).Do()
 		if err != nil {
-			log.Fatal(err)
-		} else {
-			log.Infof("Created Index %v", s.Index)
+			return err
 		}
-
-		if createIndex.IsError() {
-			log.Fatalln("Could not create the Elastic index.. Exiting")
+		exists.Body.Close()
+
+		if exists.StatusCode == http.StatusNotFound {
+			createIndex, err := client.Indices.Create(
+				s.Index,
+				client.Indices.Create.WithBody(nil),
+			)
+			if err != nil {
+				return err
+			}
+			createIndex.Body.Close()
+
+			if createIndex.IsError() {
+				return fmt.Errorf("could not create the Elastic index %s: %s", s.Index, createIndex.Status())
+			}
+			log.Infof("Created Index %v", s.Index)
+		} else if exists.IsError() {
+			return fmt.Errorf("could not check index %s: %s", s.Index, exists.Status())
 		}
-
 	}
 
-	bi, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+	s.failed = newFailedLines("elastic", s.spoolKey())
+	s.errors = newBulkErrors()
+	onFlushStart, onError, onFlushEnd := globalMetrics.bulkCallbacks("elastic")
+	s.config = esutil.BulkIndexerConfig{
 		Index:         s.Index,         // The default index name
 		Client:        client,          // The Elasticsearch client
 		NumWorkers:    8,               // The number of worker goroutines
 		FlushBytes:    int(5e+6),       // The flush threshold in bytes
 		FlushInterval: 4 * time.Second, // The periodic flush interval
-	})
+		Pipeline:      s.Pipeline,      // The ingest pipeline, if any
+		OnError:       onError,
+		OnFlushStart:  onFlushStart,
+		OnFlushEnd:    onFlushEnd,
+	}
+	s.bi, err = esutil.NewBulkIndexer(s.config)
 	if err != nil {
-		log.Fatalf("Error creating the indexer: %s", err)
+		return fmt.Errorf("error creating the indexer: %w", err)
 	}
+	return nil
+}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	buf := make([]byte, 0, 640*1024)
-	scanner.Buffer(buf, 1024*1024*10)
-
-	cnt := 0
-	for scanner.Scan() {
-		err = bi.Add(
-			context.Background(),
-			esutil.BulkIndexerItem{
-				// Action field configures the operation to perform (index, create, delete, update)
-				Action: "index",
-
-				// DocumentID is the (optional) document ID
-				// DocumentID: strconv.Itoa(a.ID),
-
-				// Body is an `io.Reader` with the payload
-				Body: bytes.NewReader([]byte(scanner.Text())),
-
-				// OnSuccess is called for each successful operation
-				// OnSuccess: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem) {
-				// 	atomic.AddUint64(&countSuccessful, 1)
-				// },
-
-				// OnFailure is called for each failed operation
-				OnFailure: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
-					if err != nil {
-						log.Printf("ERROR: %s", err)
-					} else {
-						log.Printf("ERROR: %s: %s", res.Error.Type, res.Error.Reason)
-					}
-				},
-			},
-		)
+func (s *elastic) Send(line string) {
+	// Action field configures the operation to perform (index, create, delete, update).
+	// data streams only accept create
+	action := "index"
+	if s.DataStream {
+		action = "create"
+	}
+	err := s.bi.Add(
+		context.Background(),
+		esutil.BulkIndexerItem{
+			Action: action,
 
-		cnt++
-		if cnt%1000 == 0 {
-			log.Infoln(cnt)
-		}
+			// Index overrides the default index when it's not empty
+			Index: indexFromField(line, s.IndexField),
 
+			// Body is an `io.Reader` with the payload
+			Body: bytes.NewReader([]byte(line)),
+
+			// OnSuccess is called for each successful operation
+			OnSuccess: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem) {
+				globalMetrics.bulkItem(ctx)
+				globalMetrics.sent("elastic", 1, len(line))
+			},
+
+			// OnFailure is called for each failed operation
+			OnFailure: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+				globalMetrics.bulkItem(ctx)
+				if err != nil {
+					s.errors.Add(err.Error())
+				} else {
+					s.errors.Add(fmt.Sprintf("%d %s: %s", res.Status, res.Error.Type, res.Error.Reason))
+				}
+				s.failed.Add(line)
+			},
+		},
+	)
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+		s.failed.Add(line)
 	}
-	if err := bi.Close(context.Background()); err != nil {
-		log.Fatalf("Unexpected error: %s", err)
-	}
+}
 
-	time.Sleep(5 * time.Second)
+// closeIndexer closes the bulk indexer, which sends what it has, and adds up its stats
+func (s *elastic) closeIndexer() error {
+	err := s.bi.Close(context.Background())
+	stats := s.bi.Stats()
+	s.stats.NumAdded += stats.NumAdded
+	s.stats.NumFlushed += stats.NumFlushed
+	s.stats.NumFailed += stats.NumFailed
+	s.stats.NumIndexed += stats.NumIndexed
+	s.stats.NumCreated += stats.NumCreated
+	s.stats.NumUpdated += stats.NumUpdated
+	s.stats.NumDeleted += stats.NumDeleted
+	s.stats.NumRequests += stats.NumRequests
+	s.failed.Flush()
+	return err
+}
+
+// Flush closes the bulk indexer and starts a new one, it has no other way to send what it has
+func (s *elastic) Flush() error {
+	err := s.closeIndexer()
+	bi, newErr := esutil.NewBulkIndexer(s.config)
+	if newErr != nil {
+		return fmt.Errorf("error creating the indexer: %w", newErr)
+	}
+	s.bi = bi
+	return err
+}
 
+func (s *elastic) Close() error {
+	err := s.closeIndexer()
+	stats := s.stats
+	log.Infof("elastic: %d documents added, %d indexed, %d failed in %d requests",
+		stats.NumAdded, stats.NumIndexed+stats.NumCreated+stats.NumUpdated, stats.NumFailed, stats.NumRequests)
+	s.errors.Log("elastic")
+	if err != nil {
+		return err
+	}
+	if stats.NumFailed > 0 {
+		return fmt.Errorf("%d documents failed to index", stats.NumFailed)
+	}
+	return nil
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// getField looks up a dotted path like "host.name" in a decoded JSON event. a key that
+// itself contains dots is matched before descending into nested objects
+func getField(event map[string]interface{}, path string) (interface{}, bool) {
+	if v, ok := event[path]; ok {
+		return v, true
+	}
+	for i := strings.Index(path, "."); i != -1; {
+		if inner, ok := event[path[:i]].(map[string]interface{}); ok {
+			if v, ok := getField(inner, path[i+1:]); ok {
+				return v, true
+			}
+		}
+		next := strings.Index(path[i+1:], ".")
+		if next == -1 {
+			break
+		}
+		i += next + 1
+	}
+	return nil, false
+}
+
+// getFieldString is getField for fields that end up in a string, like an index name
+func getFieldString(event map[string]interface{}, path string) string {
+	v, ok := getField(event, path)
+	if !ok || v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// indexFromField returns the value of field in a JSON line, or empty if there's no such field
+func indexFromField(line, field string) string {
+	if field == "" {
+		return ""
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &event); err != nil {
+		return ""
+	}
+	return getFieldString(event, field)
+}
+
+// setField sets a dotted path, creating the nested objects on the way. a top level key with dots
+// in its name is overwritten in place instead
+func setField(event map[string]interface{}, path string, value interface{}) {
+	if _, ok := event[path]; ok {
+		event[path] = value
+		return
+	}
+	parts := strings.Split(path, ".")
+	cur := event
+	for _, p := range parts[:len(parts)-1] {
+		next, ok := cur[p].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			cur[p] = next
+		}
+		cur = next
+	}
+	cur[parts[len(parts)-1]] = value
+}
+
+// deleteField removes a dotted path and reports whether it was there
+func deleteField(event map[string]interface{}, path string) bool {
+	if _, ok := event[path]; ok {
+		delete(event, path)
+		return true
+	}
+	for i := strings.Index(path, "."); i != -1; {
+		if inner, ok := event[path[:i]].(map[string]interface{}); ok {
+			if deleteField(inner, path[i+1:]) {
+				return true
+			}
+		}
+		next := strings.Index(path[i+1:], ".")
+		if next == -1 {
+			break
+		}
+		i += next + 1
+	}
+	return false
+}
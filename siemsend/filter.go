@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// filter expressions select events by their JSON fields, e.g.
+//
+//	event.severity == "debug" || (host.name =~ "^web" && !exists(user.name))
+//
+// comparisons are ==, !=, =~ (regex), !~, <, <=, > and >=. values are double quoted strings,
+// numbers, true, false or null. a field on its own is true when it exists and isn't false, null,
+// 0 or "". exists(field) is true when the field is there at all
+type filterExpr interface {
+	eval(event map[string]interface{}) bool
+}
+
+type filterAnd struct{ left, right filterExpr }
+type filterOr struct{ left, right filterExpr }
+type filterNot struct{ expr filterExpr }
+type filterExists struct{ field string }
+type filterTruthy struct{ field string }
+type filterCompare struct {
+	field string
+	op    string
+	value interface{}
+	re    *regexp.Regexp
+}
+
+func (f filterAnd) eval(e map[string]interface{}) bool    { return f.left.eval(e) && f.right.eval(e) }
+func (f filterOr) eval(e map[string]interface{}) bool     { return f.left.eval(e) || f.right.eval(e) }
+func (f filterNot) eval(e map[string]interface{}) bool    { return !f.expr.eval(e) }
+func (f filterExists) eval(e map[string]interface{}) bool { _, ok := getField(e, f.field); return ok }
+
+func (f filterTruthy) eval(e map[string]interface{}) bool {
+	v, ok := getField(e, f.field)
+	if !ok {
+		return false
+	}
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case json.Number:
+		n, err := v.Float64()
+		return err != nil || n != 0
+	}
+	return true
+}
+
+func (f filterCompare) eval(e map[string]interface{}) bool {
+	v, ok := getField(e, f.field)
+	switch f.op {
+	case "=~", "!~":
+		matched := ok && v != nil && f.re.MatchString(fmt.Sprint(v))
+		return matched == (f.op == "=~")
+	case "==":
+		return ok && filterEqual(v, f.value)
+	case "!=":
+		return !ok || !filterEqual(v, f.value)
+	}
+	if !ok {
+		return false
+	}
+	// ordering compares numbers as numbers and everything else as strings
+	a, aok := filterNumber(v)
+	b, bok := filterNumber(f.value)
+	var cmp int
+	if aok && bok {
+		switch {
+		case a < b:
+			cmp = -1
+		case a > b:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(fmt.Sprint(v), fmt.Sprint(f.value))
+	}
+	switch f.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func filterNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		n, err := v.Float64()
+		return n, err == nil
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(v, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func filterEqual(v, want interface{}) bool {
+	if want == nil || v == nil {
+		return want == nil && v == nil
+	}
+	if b, ok := want.(bool); ok {
+		got, ok := v.(bool)
+		return ok && got == b
+	}
+	if a, ok := filterNumber(want); ok {
+		if _, isString := want.(string); !isString {
+			b, ok := filterNumber(v)
+			return ok && a == b
+		}
+	}
+	return fmt.Sprint(v) == fmt.Sprint(want)
+}
+
+// filterParser is a recursive descent parser over the tokens of an expression
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func parseFilter(s string) (filterExpr, error) {
+	tokens, err := filterTokens(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	expr, err := p.or()
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", s, err)
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("%q: unexpected %s", s, p.tokens[p.pos])
+	}
+	return expr, nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *filterParser) or() (filterExpr, error) {
+	left, err := p.and()
+	for err == nil && p.peek() == "||" {
+		p.next()
+		var right filterExpr
+		right, err = p.and()
+		left = filterOr{left, right}
+	}
+	return left, err
+}
+
+func (p *filterParser) and() (filterExpr, error) {
+	left, err := p.unary()
+	for err == nil && p.peek() == "&&" {
+		p.next()
+		var right filterExpr
+		right, err = p.unary()
+		left = filterAnd{left, right}
+	}
+	return left, err
+}
+
+func (p *filterParser) unary() (filterExpr, error) {
+	switch t := p.next(); {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case t == "!":
+		expr, err := p.unary()
+		return filterNot{expr}, err
+	case t == "(":
+		expr, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return expr, nil
+	case t == "exists" && p.peek() == "(":
+		p.next()
+		field := p.next()
+		if !isFilterField(field) || p.next() != ")" {
+			return nil, fmt.Errorf("exists takes one field")
+		}
+		return filterExists{field}, nil
+	case isFilterField(t):
+		op := p.peek()
+		switch op {
+		case "==", "!=", "=~", "!~", "<", "<=", ">", ">=":
+			p.next()
+		default:
+			return filterTruthy{t}, nil
+		}
+		value, err := filterValue(p.next())
+		if err != nil {
+			return nil, err
+		}
+		cmp := filterCompare{field: t, op: op, value: value}
+		if op == "=~" || op == "!~" {
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s needs a quoted regex", op)
+			}
+			if cmp.re, err = regexp.Compile(s); err != nil {
+				return nil, err
+			}
+		}
+		return cmp, nil
+	default:
+		return nil, fmt.Errorf("unexpected %s", t)
+	}
+}
+
+func isFilterField(t string) bool {
+	if t == "" || t == "true" || t == "false" || t == "null" {
+		return false
+	}
+	r := rune(t[0])
+	return r == '_' || r == '@' || unicode.IsLetter(r)
+}
+
+func filterValue(t string) (interface{}, error) {
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("missing value")
+	case t[0] == '"':
+		return strconv.Unquote(t)
+	case t == "true":
+		return true, nil
+	case t == "false":
+		return false, nil
+	case t == "null":
+		return nil, nil
+	}
+	if _, err := strconv.ParseFloat(t, 64); err != nil {
+		return nil, fmt.Errorf("values must be quoted strings, numbers, true, false or null: %s", t)
+	}
+	return json.Number(t), nil
+}
+
+// filterTokens splits an expression into fields, values, operators and parentheses
+func filterTokens(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string in %q", s)
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		case strings.ContainsRune("=!<>&|~", rune(c)):
+			j := i + 1
+			for j < len(s) && strings.ContainsRune("=!<>&|~", rune(s[j])) && j-i < 2 {
+				j++
+			}
+			op := s[i:j]
+			// "!" followed by something that isn't an operator, like !exists(...) or !(...)
+			if op != "!=" && op != "!~" && strings.HasPrefix(op, "!") {
+				op = "!"
+				j = i + 1
+			}
+			tokens = append(tokens, op)
+			i = j
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t()\"=!<>&|~", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// httpOutput posts batches of events to any HTTP endpoint: webhooks, Loki, Datadog, Logstash's http input etc.
+// the body is the batch as JSONL unless a template is given
+type httpOutput struct {
+	URL          string
+	Method       string
+	Headers      []string
+	ContentType  string
+	BatchSize    uint
+	Template     string
+	TemplateFile string
+	Gzip         bool
+	Proxy        string
+	Timeout      time.Duration
+	TLS          tlsOptions
+	client       *http.Client
+	tmpl         *template.Template
+	header       http.Header
+	batch        []string
+}
+
+// httpTemplateData is what the body template is executed with
+type httpTemplateData struct {
+	// Lines are the raw input lines of the batch
+	Lines []string
+	// Events are the lines decoded from JSON. a line that isn't JSON is kept as a string
+	Events []interface{}
+}
+
+var httpTemplateFuncs = template.FuncMap{
+	// json encodes any value, e.g. a line as a JSON string: {{json .}}
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join": strings.Join,
+	"now":  time.Now,
+}
+
+var _ = httpOutput{}.init()
+
+func (h httpOutput) init() error {
+	httpCmd := &cobra.Command{
+		Use:   "http [arguments]",
+		Short: "send input data to a HTTP endpoint or webhook",
+		Long: `each batch of lines is sent as one request. the body is the batch as JSONL, or the output of --template.
+the template is a Go text/template executed with .Lines (the raw lines) and .Events (the lines decoded from JSON),
+and the functions json, join and now. e.g. a JSON array: [{{join .Lines ","}}]`,
+		Args: cobra.ExactArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			runOutput(&h)
+		},
+	}
+	h.flags(httpCmd.Flags())
+	outputs["http"] = func(flags *pflag.FlagSet) GenericOutput {
+		o := &httpOutput{}
+		o.flags(flags)
+		return o
+	}
+	rootCmd.AddCommand(httpCmd)
+	return nil
+}
+
+func (h *httpOutput) flags(flags *pflag.FlagSet) {
+	flags.StringVarP(&h.URL, "url", "u", "", "URL to send the events to")
+	flags.StringVarP(&h.Method, "method", "X", "POST", "HTTP method")
+	flags.StringArrayVarP(&h.Headers, "header", "H", []string{}, "extra header as 'Name: value', can be repeated")
+	flags.StringVarP(&h.ContentType, "content-type", "", "application/x-ndjson", "Content-Type of the request")
+	flags.UintVarP(&h.BatchSize, "batch-size", "b", 100, "number of events sent in each request")
+	flags.StringVarP(&h.Template, "template", "", "", "Go text/template for the request body")
+	flags.StringVarP(&h.TemplateFile, "template-file", "", "", "file with the Go text/template for the request body")
+	flags.BoolVarP(&h.Gzip, "gzip", "", false, "gzip the request body")
+	flags.StringVarP(&h.Proxy, "proxy", "", "", "proxy url")
+	flags.DurationVarP(&h.Timeout, "timeout", "", 30*time.Second, "timeout of each request")
+	h.TLS.flags(flags)
+}
+
+func (h *httpOutput) spoolKey() string {
+	return spoolKey(h.URL)
+}
+
+func (h *httpOutput) Init() error {
+	if h.URL == "" {
+		return fmt.Errorf("--url is required")
+	}
+	if h.BatchSize == 0 {
+		h.BatchSize = 1
+	}
+	if h.TemplateFile != "" {
+		b, err := os.ReadFile(h.TemplateFile)
+		if err != nil {
+			return err
+		}
+		h.Template = string(b)
+	}
+	if h.Template != "" {
+		tmpl, err := template.New("body").Funcs(httpTemplateFuncs).Parse(h.Template)
+		if err != nil {
+			return err
+		}
+		h.tmpl = tmpl
+	}
+	h.header = http.Header{}
+	for _, hdr := range h.Headers {
+		k, v, ok := strings.Cut(hdr, ":")
+		if !ok {
+			return fmt.Errorf("header %q is not in 'Name: value' format", hdr)
+		}
+		h.header.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+	tlsConfig, err := h.TLS.Config()
+	if err != nil {
+		return err
+	}
+	tr := &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}
+	if h.Proxy != "" {
+		proxyURL, err := url.Parse(h.Proxy)
+		if err != nil {
+			return err
+		}
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
+	h.client = &http.Client{Timeout: h.Timeout, Transport: tr}
+	return nil
+}
+
+func (h *httpOutput) Send(line string) {
+	h.batch = append(h.batch, line)
+	if len(h.batch) >= int(h.BatchSize) {
+		h.sendBatch()
+	}
+}
+
+func (h *httpOutput) sendBatch() {
+	if len(h.batch) == 0 {
+		return
+	}
+	defer func() {
+		h.batch = nil
+	}()
+	body, err := h.body(h.batch)
+	if err == nil {
+		err = globalSpool.retry("http", func() error {
+			return h.post(body)
+		})
+	}
+	if err != nil {
+		log.Errorf("batch not sent: %s", err)
+		globalSpool.Write("http", h.spoolKey(), h.batch)
+		return
+	}
+	globalMetrics.sent("http", len(h.batch), linesSize(h.batch))
+}
+
+// body renders the request body of a batch, gzipped if asked to
+func (h *httpOutput) body(lines []string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if h.Gzip {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+	if h.tmpl != nil {
+		data := httpTemplateData{Lines: lines}
+		for _, l := range lines {
+			var event interface{}
+			if err := json.Unmarshal([]byte(l), &event); err != nil {
+				event = l
+			}
+			data.Events = append(data.Events, event)
+		}
+		if err := h.tmpl.Execute(w, data); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, l := range lines {
+			io.WriteString(w, l)
+			io.WriteString(w, "\n")
+		}
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (h *httpOutput) post(body []byte) error {
+	req, err := http.NewRequest(h.Method, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	for k, v := range h.header {
+		req.Header[k] = v
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", h.ContentType)
+	}
+	if h.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		log.Infof("batch sent, with code %d", res.StatusCode)
+		return nil
+	}
+	err = fmt.Errorf("batch not sent, with code %d: %s", res.StatusCode, bytes.TrimSpace(resBody))
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+		return retryAfterError{err: err, after: parseRetryAfter(res.Header.Get("Retry-After"))}
+	}
+	return permanentError{err}
+}
+
+// parseRetryAfter reads a Retry-After header, either in seconds or as a HTTP date. the wait is
+// never longer than --retry-max-backoff, so a server can't stall the sender for a day
+func parseRetryAfter(v string) time.Duration {
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = time.Until(t)
+	}
+	if d < 0 {
+		return 0
+	}
+	if d > globalSpool.MaxBackoff {
+		return globalSpool.MaxBackoff
+	}
+	return d
+}
+
+func (h *httpOutput) Flush() error {
+	h.sendBatch()
+	return nil
+}
+
+func (h *httpOutput) Close() error {
+	h.sendBatch()
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	maxBackoff := globalSpool.MaxBackoff
+	t.Cleanup(func() { globalSpool.MaxBackoff = maxBackoff })
+	globalSpool.MaxBackoff = 30 * time.Second
+
+	for _, c := range []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"-5", 0},
+		{"86400", 30 * time.Second},
+		{"soon", 0},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+		{time.Now().Add(24 * time.Hour).UTC().Format(http.TimeFormat), 30 * time.Second},
+	} {
+		if got := parseRetryAfter(c.header); got != c.want {
+			t.Errorf("Retry-After %q waits %s, want %s", c.header, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// inputDecoder turns each line of stdin into a JSON event before it reaches the transform steps
+// and the output. lines that can't be decoded go to the dead letter file instead of a batch
+type inputDecoder struct {
+	Format       string
+	DeadLetter   string
+	CSVHeader    []string
+	CSVDelimiter string
+	decode       func(line string) (map[string]interface{}, error)
+	deadLetter   *os.File
+	lock         sync.Mutex
+	dead         uint64
+}
+
+var globalInput = &inputDecoder{}
+
+var _ = globalInput.init()
+
+func (d *inputDecoder) init() error {
+	flags := rootCmd.PersistentFlags()
+	flags.StringVarP(&d.Format, "input-format", "", "json", "format of the input lines: json, csv, logfmt, syslog (RFC 5424), cef or text")
+	flags.StringVarP(&d.DeadLetter, "dead-letter", "", "", "file the lines that fail to decode are appended to. they're logged if it's not set")
+	flags.StringSliceVarP(&d.CSVHeader, "csv-header", "", []string{}, "column names for csv input. the first line is the header if not set")
+	flags.StringVarP(&d.CSVDelimiter, "csv-delimiter", "", ",", "field delimiter for csv input")
+	return nil
+}
+
+// Load picks the decoder for --input-format and opens the dead letter file
+func (d *inputDecoder) Load() error {
+	switch d.Format {
+	case "json", "":
+		d.decode = nil
+	case "csv":
+		delim := []rune(d.CSVDelimiter)
+		if len(delim) != 1 {
+			return fmt.Errorf("--csv-delimiter must be a single character")
+		}
+		header := d.CSVHeader
+		d.decode = func(line string) (map[string]interface{}, error) {
+			r := csv.NewReader(strings.NewReader(line))
+			r.Comma = delim[0]
+			r.FieldsPerRecord = -1
+			r.LazyQuotes = true
+			record, err := r.Read()
+			if err != nil {
+				return nil, err
+			}
+			// the first line is the header when there's no --csv-header
+			if len(header) == 0 {
+				header = record
+				return nil, nil
+			}
+			if len(record) != len(header) {
+				return nil, fmt.Errorf("%d columns, the header has %d", len(record), len(header))
+			}
+			event := make(map[string]interface{}, len(header))
+			for i, name := range header {
+				setField(event, name, record[i])
+			}
+			return event, nil
+		}
+	case "logfmt":
+		d.decode = parseLogfmt
+	case "syslog":
+		d.decode = parseRFC5424
+	case "cef":
+		d.decode = parseCEF
+	case "text":
+		d.decode = func(line string) (map[string]interface{}, error) {
+			return map[string]interface{}{"message": line}, nil
+		}
+	default:
+		return fmt.Errorf("unknown --input-format %s", d.Format)
+	}
+	if d.DeadLetter != "" {
+		f, err := os.OpenFile(d.DeadLetter, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		d.deadLetter = f
+	}
+	return nil
+}
+
+// Decode returns the line as a JSON event. ok is false when there's nothing to send, either
+// because the line is empty, a csv header, or it went to the dead letter file
+func (d *inputDecoder) Decode(line string) (string, bool) {
+	if strings.TrimSpace(line) == "" {
+		return "", false
+	}
+	if d.decode == nil {
+		if !json.Valid([]byte(line)) {
+			d.reject(line, fmt.Errorf("invalid JSON"))
+			return "", false
+		}
+		return line, true
+	}
+	event, err := d.decode(line)
+	if err != nil {
+		d.reject(line, err)
+		return "", false
+	}
+	if event == nil {
+		return "", false
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(event); err != nil {
+		d.reject(line, err)
+		return "", false
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), true
+}
+
+func (d *inputDecoder) reject(line string, reason error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.dead++
+	if d.deadLetter == nil {
+		log.Warnf("could not decode %s input: %s: %q", d.Format, reason, line)
+		return
+	}
+	if _, err := fmt.Fprintln(d.deadLetter, line); err != nil {
+		log.Errorf("could not write to the dead letter file: %s", err)
+	}
+}
+
+// Close closes the dead letter file and reports how many lines went to it
+func (d *inputDecoder) Close() error {
+	if d.dead != 0 {
+		log.Warnf("%d lines could not be decoded as %s", d.dead, d.Format)
+	}
+	if d.deadLetter == nil {
+		return nil
+	}
+	return d.deadLetter.Close()
+}
+
+// parseLogfmt decodes key=value pairs separated by spaces. values can be double quoted, and a
+// key without a value is true
+func parseLogfmt(line string) (map[string]interface{}, error) {
+	event := make(map[string]interface{})
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(line) && line[j] != '=' && line[j] != ' ' && line[j] != '\t' {
+			j++
+		}
+		key := line[i:j]
+		if key == "" {
+			return nil, fmt.Errorf("missing key at position %d", i)
+		}
+		if j == len(line) || line[j] != '=' {
+			event[key] = true
+			i = j
+			continue
+		}
+		j++
+		if j < len(line) && line[j] == '"' {
+			k := j + 1
+			for ; k < len(line) && line[k] != '"'; k++ {
+				if line[k] == '\\' {
+					k++
+				}
+			}
+			if k >= len(line) {
+				return nil, fmt.Errorf("unterminated quote for %s", key)
+			}
+			v, err := strconv.Unquote(line[j : k+1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			event[key] = v
+			i = k + 1
+			continue
+		}
+		k := j
+		for k < len(line) && line[k] != ' ' && line[k] != '\t' {
+			k++
+		}
+		event[key] = line[j:k]
+		i = k
+	}
+	if len(event) == 0 {
+		return nil, fmt.Errorf("no key=value pairs")
+	}
+	return event, nil
+}
+
+// parseRFC5424 decodes a syslog line in the RFC 5424 format:
+//
+//	<PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+//
+// the header fields that are "-" are left out of the event
+func parseRFC5424(line string) (map[string]interface{}, error) {
+	if !strings.HasPrefix(line, "<") {
+		return nil, fmt.Errorf("missing priority")
+	}
+	end := strings.IndexByte(line, '>')
+	if end < 2 || end > 4 {
+		return nil, fmt.Errorf("invalid priority")
+	}
+	pri, err := strconv.Atoi(line[1:end])
+	if err != nil || pri > 191 {
+		return nil, fmt.Errorf("invalid priority %s", line[1:end])
+	}
+	rest := line[end+1:]
+	fields := strings.SplitN(rest, " ", 7)
+	if len(fields) < 7 {
+		return nil, fmt.Errorf("incomplete RFC 5424 header")
+	}
+	if fields[0] != "1" {
+		return nil, fmt.Errorf("unsupported syslog version %s", fields[0])
+	}
+	event := map[string]interface{}{
+		"facility": pri / 8,
+		"severity": pri % 8,
+	}
+	for i, name := range []string{"", "timestamp", "hostname", "app_name", "proc_id", "msg_id"} {
+		if name != "" && fields[i] != "-" {
+			event[name] = fields[i]
+		}
+	}
+	sd, msg, err := parseStructuredData(fields[6])
+	if err != nil {
+		return nil, err
+	}
+	if len(sd) != 0 {
+		event["structured_data"] = sd
+	}
+	// a BOM marks the message as UTF-8, it's not part of it
+	msg = strings.TrimPrefix(msg, "\ufeff")
+	if msg != "" {
+		event["message"] = msg
+	}
+	return event, nil
+}
+
+// parseStructuredData decodes the [id key="value" ...] elements at the start of s and returns
+// them by id, along with the message after them
+func parseStructuredData(s string) (map[string]interface{}, string, error) {
+	sd := make(map[string]interface{})
+	if strings.HasPrefix(s, "-") {
+		return sd, strings.TrimPrefix(strings.TrimPrefix(s, "-"), " "), nil
+	}
+	i := 0
+	for i < len(s) && s[i] == '[' {
+		j := i + 1
+		for j < len(s) && s[j] != ' ' && s[j] != ']' {
+			j++
+		}
+		id := s[i+1 : j]
+		params := make(map[string]interface{})
+		for j < len(s) && s[j] != ']' {
+			j++ // the space before each param
+			eq := strings.IndexByte(s[j:], '=')
+			if eq == -1 || j+eq+1 >= len(s) || s[j+eq+1] != '"' {
+				return nil, "", fmt.Errorf("invalid structured data param in %s", id)
+			}
+			name := s[j : j+eq]
+			var value strings.Builder
+			k := j + eq + 2
+			for ; k < len(s) && s[k] != '"'; k++ {
+				// only ", \ and ] are escaped
+				if s[k] == '\\' && k+1 < len(s) && strings.IndexByte(`"\]`, s[k+1]) != -1 {
+					k++
+				}
+				value.WriteByte(s[k])
+			}
+			if k >= len(s) {
+				return nil, "", fmt.Errorf("unterminated structured data param %s", name)
+			}
+			params[name] = value.String()
+			j = k + 1
+		}
+		if j >= len(s) {
+			return nil, "", fmt.Errorf("unterminated structured data element %s", id)
+		}
+		sd[id] = params
+		i = j + 1
+	}
+	if i == 0 {
+		return nil, "", fmt.Errorf("invalid structured data")
+	}
+	return sd, strings.TrimPrefix(s[i:], " "), nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// kafkaOutput publishes each line as a message to a Kafka topic
+type kafkaOutput struct {
+	Brokers       []string
+	Topic         string
+	KeyField      string
+	Acks          string
+	Compression   string
+	BatchSize     int
+	BatchTimeout  time.Duration
+	SASLMechanism string
+	SASLUsername  string
+	SASLPassword  string
+	UseTLS        bool
+	TLS           tlsOptions
+	writer        *kafka.Writer
+	failed        *failedLines
+	// pending is the number of messages written and not completed yet, Flush waits on done for
+	// it to reach 0
+	pending int
+	done    *sync.Cond
+}
+
+var _ = kafkaOutput{}.init()
+
+func (k kafkaOutput) init() error {
+	kafkaCmd := &cobra.Command{
+		Use:   "kafka [arguments]",
+		Short: "send input data to a Kafka topic",
+		Long:  `each line is published as one message. with --key-field the message key is taken from a JSON field, so events with the same key end up in the same partition.`,
+		Args:  cobra.ExactArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			runOutput(&k)
+		},
+	}
+	k.flags(kafkaCmd.Flags())
+	outputs["kafka"] = func(flags *pflag.FlagSet) GenericOutput {
+		o := &kafkaOutput{}
+		o.flags(flags)
+		return o
+	}
+	rootCmd.AddCommand(kafkaCmd)
+	return nil
+}
+
+func (k *kafkaOutput) flags(flags *pflag.FlagSet) {
+	flags.StringSliceVarP(&k.Brokers, "brokers", "", []string{}, "Kafka brokers as host:port, can be repeated")
+	flags.StringVarP(&k.Topic, "topic", "", "", "topic to publish to")
+	flags.StringVarP(&k.KeyField, "key-field", "", "", "JSON field used as the message key, picks the partition")
+	flags.StringVarP(&k.Acks, "acks", "", "all", "acknowledgements to wait for: none, one or all")
+	flags.StringVarP(&k.Compression, "compression", "", "none", "none, gzip, snappy, lz4 or zstd")
+	flags.IntVarP(&k.BatchSize, "batch-size", "", 100, "maximum number of messages in each produce request")
+	flags.DurationVarP(&k.BatchTimeout, "batch-timeout", "", time.Second, "send an incomplete batch after this long")
+	flags.StringVarP(&k.SASLMechanism, "sasl-mechanism", "", "", "plain, scram-sha-256 or scram-sha-512. empty disables SASL")
+	flags.StringVarP(&k.SASLUsername, "sasl-username", "", "", "SASL username")
+	flags.StringVarP(&k.SASLPassword, "sasl-password", "", "", "SASL password")
+	flags.BoolVarP(&k.UseTLS, "tls", "", false, "connect to the brokers over TLS")
+	k.TLS.flags(flags)
+}
+
+func (k *kafkaOutput) spoolKey() string {
+	return spoolKey(append(append([]string{}, k.Brokers...), k.Topic)...)
+}
+
+func (k *kafkaOutput) Init() error {
+	if len(k.Brokers) == 0 || k.Topic == "" {
+		return fmt.Errorf("--brokers and --topic are required")
+	}
+	transport := &kafka.Transport{ClientID: "siemsend"}
+	if k.UseTLS {
+		tlsConfig, err := k.TLS.Config()
+		if err != nil {
+			return err
+		}
+		transport.TLS = tlsConfig
+	}
+	var mechanism sasl.Mechanism
+	var err error
+	switch k.SASLMechanism {
+	case "":
+	case "plain":
+		mechanism = plain.Mechanism{Username: k.SASLUsername, Password: k.SASLPassword}
+	case "scram-sha-256":
+		mechanism, err = scram.Mechanism(scram.SHA256, k.SASLUsername, k.SASLPassword)
+	case "scram-sha-512":
+		mechanism, err = scram.Mechanism(scram.SHA512, k.SASLUsername, k.SASLPassword)
+	default:
+		err = fmt.Errorf("unknown SASL mechanism %s", k.SASLMechanism)
+	}
+	if err != nil {
+		return err
+	}
+	transport.SASL = mechanism
+
+	var acks kafka.RequiredAcks
+	switch k.Acks {
+	case "none":
+		acks = kafka.RequireNone
+	case "one":
+		acks = kafka.RequireOne
+	case "all":
+		acks = kafka.RequireAll
+	default:
+		return fmt.Errorf("unknown acks %s", k.Acks)
+	}
+	var compression kafka.Compression
+	switch k.Compression {
+	case "none":
+	case "gzip":
+		compression = kafka.Gzip
+	case "snappy":
+		compression = kafka.Snappy
+	case "lz4":
+		compression = kafka.Lz4
+	case "zstd":
+		compression = kafka.Zstd
+	default:
+		return fmt.Errorf("unknown compression %s", k.Compression)
+	}
+
+	k.failed = newFailedLines("kafka", k.spoolKey())
+	k.done = sync.NewCond(&sync.Mutex{})
+	k.writer = &kafka.Writer{
+		Addr:  kafka.TCP(k.Brokers...),
+		Topic: k.Topic,
+		// same partitioning as the Java client. messages without a key are spread randomly
+		Balancer:        &kafka.Murmur2Balancer{},
+		RequiredAcks:    acks,
+		Compression:     compression,
+		BatchSize:       k.BatchSize,
+		BatchTimeout:    k.BatchTimeout,
+		MaxAttempts:     int(globalSpool.Retries) + 1,
+		WriteBackoffMin: globalSpool.Backoff,
+		WriteBackoffMax: globalSpool.MaxBackoff,
+		Transport:       transport,
+		Async:           true,
+		Completion: func(messages []kafka.Message, err error) {
+			defer k.completed(len(messages))
+			globalMetrics.batch("kafka", err)
+			if err == nil {
+				size := 0
+				for _, m := range messages {
+					size += len(m.Value)
+				}
+				globalMetrics.sent("kafka", len(messages), size)
+				return
+			}
+			log.Errorf("%d messages not sent: %s", len(messages), err)
+			for _, m := range messages {
+				k.failed.Add(string(m.Value))
+			}
+		},
+	}
+	return nil
+}
+
+func (k *kafkaOutput) Send(line string) {
+	msg := kafka.Message{Value: []byte(line)}
+	if k.KeyField != "" {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err == nil {
+			if key := getFieldString(event, k.KeyField); key != "" {
+				msg.Key = []byte(key)
+			}
+		}
+	}
+	// with Async, errors are reported to Completion instead
+	if err := k.writer.WriteMessages(context.Background(), msg); err != nil {
+		log.Errorf("message not sent: %s", err)
+		k.failed.Add(line)
+		return
+	}
+	k.done.L.Lock()
+	k.pending++
+	k.done.L.Unlock()
+}
+
+// completed is called by Completion for n messages, sent or failed
+func (k *kafkaOutput) completed(n int) {
+	k.done.L.Lock()
+	k.pending -= n
+	k.done.L.Unlock()
+	k.done.Broadcast()
+}
+
+// Flush waits for the messages written so far to complete, the writer sends a batch that isn't
+// full after --batch-timeout
+func (k *kafkaOutput) Flush() error {
+	k.done.L.Lock()
+	for k.pending > 0 {
+		k.done.Wait()
+	}
+	k.done.L.Unlock()
+	k.failed.Flush()
+	return nil
+}
+
+func (k *kafkaOutput) Close() error {
+	// Close flushes the pending messages and waits for their Completion
+	err := k.writer.Close()
+	k.failed.Flush()
+	stats := k.writer.Stats()
+	log.Infof("kafka: %d messages written, %d errors", stats.Messages, stats.Errors)
+	return err
+}
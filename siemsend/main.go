@@ -3,18 +3,98 @@
 package main
 
 import (
+	"os"
+
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var rootCmd = &cobra.Command{Use: "siemsend"}
 
-// GenericOutput interface for all outputs for possible multi-output option
+// GenericOutput interface for all outputs. Init connects to the output, Send is called once per
+// input line and Close flushes whatever is still buffered. Flush sends what's buffered too and
+// returns once it's delivered or spooled, so the input can be checkpointed up to there. used by
+// each subcommand and by multi
 type GenericOutput interface {
 	Send(string)
 	Init() error
+	Flush() error
+	Close() error
+}
+
+// outputs maps each subcommand name to a constructor that binds a fresh output to a FlagSet,
+// so multi can build several independent instances of the same output
+var outputs = map[string]func(*pflag.FlagSet) GenericOutput{}
+
+// runOutput reads the inputs and hands each line to the output until they're done or siemsend is
+// stopped. every line is decoded according to --input-format and goes through the transform steps first
+func runOutput(o GenericOutput) {
+	if err := globalInput.Load(); err != nil {
+		log.Fatal(err)
+	}
+	if err := globalTransform.Load(); err != nil {
+		log.Fatal(err)
+	}
+	if err := globalMetrics.Start(); err != nil {
+		log.Fatal(err)
+	}
+	if err := o.Init(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := globalSource.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	cnt := 0
+	for {
+		l, more := globalSource.Next()
+		if !more {
+			break
+		}
+		if l.flush {
+			// the checkpoint only moves past the lines the output has delivered or spooled
+			if err := o.Flush(); err != nil {
+				log.Errorf("checkpoint not written, the output could not flush: %s", err)
+			} else if err := globalSource.Commit(); err != nil {
+				log.Errorf("could not write the checkpoint: %s", err)
+			}
+			continue
+		}
+		globalMetrics.read.Inc()
+		line, ok := globalInput.Decode(l.text)
+		if !ok {
+			globalMetrics.dropped.WithLabelValues("decode").Inc()
+		} else if line, ok = globalTransform.Apply(line); !ok {
+			globalMetrics.dropped.WithLabelValues("filter").Inc()
+		} else {
+			o.Send(line)
+		}
+		globalSource.Done(l)
+		cnt++
+		if cnt%1000 == 0 {
+			log.Infoln(cnt)
+		}
+	}
+	if err := globalInput.Close(); err != nil {
+		log.Error(err)
+	}
+	closeErr := o.Close()
+	if closeErr != nil {
+		log.Error(closeErr)
+	}
+	// only once the output has flushed, so a restart doesn't skip what was still buffered. an
+	// output that fails to close has spooled what it couldn't send, so the source still moves on
+	if err := globalSource.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if closeErr != nil {
+		os.Exit(1)
+	}
 }
 
 func main() {
-	//todo: possibly general flags
+	addReplayCommands()
 	rootCmd.Execute()
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// metrics counts what siemsend reads and what each output does with it. they're always recorded,
+// and served in the Prometheus format along with /healthz when --metrics-listen is set
+type metrics struct {
+	Listen string
+
+	registry   *prometheus.Registry
+	read       prometheus.Counter
+	dropped    *prometheus.CounterVec
+	sentEvents *prometheus.CounterVec
+	failed     *prometheus.CounterVec
+	batches    *prometheus.CounterVec
+	retries    *prometheus.CounterVec
+	bytes      *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	endpointUp *prometheus.GaugeVec
+
+	lock sync.Mutex
+	// health is the result of the last batch of each output
+	health map[string]error
+	checks []func() error
+}
+
+var globalMetrics = newMetrics()
+
+var _ = globalMetrics.init()
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		read: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "siemsend_events_read_total",
+			Help: "Lines read from stdin.",
+		}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "siemsend_events_dropped_total",
+			Help: "Lines that never reached an output, by reason: decode or filter.",
+		}, []string{"reason"}),
+		sentEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "siemsend_events_sent_total",
+			Help: "Events accepted by the output.",
+		}, []string{"output"}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "siemsend_events_failed_total",
+			Help: "Events that could not be delivered and went to the spool.",
+		}, []string{"output"}),
+		batches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "siemsend_batches_total",
+			Help: "Batches sent, by result: ok or failed. a batch is counted once, however many times it's retried.",
+		}, []string{"output", "result"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "siemsend_retries_total",
+			Help: "Retried requests.",
+		}, []string{"output"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "siemsend_bytes_sent_total",
+			Help: "Bytes of the events accepted by the output, before compression.",
+		}, []string{"output"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "siemsend_request_duration_seconds",
+			Help:    "Time each request to the output took, retries are observed separately.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+		}, []string{"output"}),
+		endpointUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "siemsend_endpoint_up",
+			Help: "1 when an endpoint of an output with several endpoints is healthy, 0 otherwise.",
+		}, []string{"output", "endpoint"}),
+		health: make(map[string]error),
+	}
+	m.registry.MustRegister(
+		m.read, m.dropped, m.sentEvents, m.failed, m.batches, m.retries, m.bytes, m.duration, m.endpointUp,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *metrics) init() error {
+	rootCmd.PersistentFlags().StringVarP(&m.Listen, "metrics-listen", "", "", "address to serve Prometheus metrics on /metrics and health on /healthz, e.g. :9090")
+	return nil
+}
+
+// Start serves the metrics in the background if --metrics-listen is set
+func (m *metrics) Start() error {
+	if m.Listen == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", m.Listen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", m.serveHealth)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Errorf("metrics server stopped: %s", err)
+		}
+	}()
+	log.Infof("serving metrics on %s", ln.Addr())
+	return nil
+}
+
+// serveHealth returns 503 when the last batch of an output failed or one of the health checks,
+// like all Splunk endpoints being unhealthy, fails
+func (m *metrics) serveHealth(w http.ResponseWriter, r *http.Request) {
+	m.lock.Lock()
+	status := map[string]interface{}{}
+	outputs := map[string]string{}
+	healthy := true
+	names := make([]string, 0, len(m.health))
+	for name := range m.health {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		outputs[name] = "ok"
+		if err := m.health[name]; err != nil {
+			outputs[name] = err.Error()
+			healthy = false
+		}
+	}
+	var problems []string
+	for _, check := range m.checks {
+		if err := check(); err != nil {
+			problems = append(problems, err.Error())
+			healthy = false
+		}
+	}
+	m.lock.Unlock()
+
+	status["outputs"] = outputs
+	if len(problems) != 0 {
+		status["problems"] = problems
+	}
+	status["status"] = "ok"
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		status["status"] = "unhealthy"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// addCheck adds a health check for outputs that know more about their state than the result of
+// the last batch
+func (m *metrics) addCheck(check func() error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.checks = append(m.checks, check)
+}
+
+// batch records the final result of a batch, after its retries
+func (m *metrics) batch(name string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "failed"
+	}
+	m.batches.WithLabelValues(name, result).Inc()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.health[name] = err
+}
+
+// request observes the duration of one request that started at start
+func (m *metrics) request(name string, start time.Time) {
+	m.duration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) sent(name string, events, bytes int) {
+	m.sentEvents.WithLabelValues(name).Add(float64(events))
+	m.bytes.WithLabelValues(name).Add(float64(bytes))
+}
+
+// linesSize is the number of bytes in lines, for sent
+func linesSize(lines []string) int {
+	n := 0
+	for _, l := range lines {
+		n += len(l)
+	}
+	return n
+}
+
+type flushStateKey struct{}
+
+// flushState follows one flush of a bulk indexer, from OnFlushStart to OnFlushEnd
+type flushState struct {
+	start time.Time
+	err   error
+	items int
+}
+
+// bulkItem marks the flush of ctx as not empty. the bulk indexers flush every worker on their
+// interval, and the flushes with nothing in them aren't counted as batches
+func (m *metrics) bulkItem(ctx context.Context) {
+	if state, ok := ctx.Value(flushStateKey{}).(*flushState); ok {
+		state.items++
+	}
+}
+
+// bulkCallbacks returns OnFlushStart, OnError and OnFlushEnd callbacks for a bulk indexer, so
+// each bulk request is recorded like a batch
+func (m *metrics) bulkCallbacks(name string) (func(context.Context) context.Context, func(context.Context, error), func(context.Context)) {
+	start := func(ctx context.Context) context.Context {
+		return context.WithValue(ctx, flushStateKey{}, &flushState{start: time.Now()})
+	}
+	onError := func(ctx context.Context, err error) {
+		log.Errorf("bulk request failed: %s", err)
+		if state, ok := ctx.Value(flushStateKey{}).(*flushState); ok {
+			state.err = err
+		} else {
+			m.batch(name, err)
+		}
+	}
+	end := func(ctx context.Context) {
+		if state, ok := ctx.Value(flushStateKey{}).(*flushState); ok && (state.items != 0 || state.err != nil) {
+			m.request(name, state.start)
+			m.batch(name, state.err)
+		}
+	}
+	return start, onError, end
+}
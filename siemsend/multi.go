@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// multi reads the input once and fans each line out to several outputs. every output
+// gets its own queue and goroutine, so a slow output doesn't stall the others
+type multi struct {
+	Outputs   []string
+	QueueSize uint
+	queues    []chan multiItem
+	// closed gets the result of each output's Close
+	closed chan error
+}
+
+// multiItem is a line for an output, or with flushed set, a request to flush it once the lines
+// queued before are sent. the result goes to flushed
+type multiItem struct {
+	line    string
+	flushed chan<- error
+}
+
+var _ = multi{}.init()
+
+func (m multi) init() error {
+	multiCmd := &cobra.Command{
+		Use:   "multi [arguments]",
+		Short: "send input data to several outputs at the same time",
+		Long: `each --output is an output name followed by that output's own flags, for example:
+siemsend multi --output "splunk --endpoint https://hec:8088 --token xyz" --output "sentinel --customer_id abc --shared_key def --log_type mylogs"`,
+		Args: cobra.ExactArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			runOutput(&m)
+		},
+	}
+	flags := multiCmd.Flags()
+	flags.StringArrayVarP(&m.Outputs, "output", "o", []string{}, "output name followed by its flags, can be repeated")
+	flags.UintVarP(&m.QueueSize, "queue-size", "", 10000, "number of lines buffered for each output before the input blocks")
+
+	rootCmd.AddCommand(multiCmd)
+	return nil
+}
+
+// newOutputFromSpec builds an output from a string like `splunk --endpoint x --token y`
+func newOutputFromSpec(spec string) (GenericOutput, error) {
+	args, err := splitArgs(spec)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty output")
+	}
+	newOutput, ok := outputs[args[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown output %s", args[0])
+	}
+	flags := pflag.NewFlagSet(args[0], pflag.ContinueOnError)
+	o := newOutput(flags)
+	if err := flags.Parse(args[1:]); err != nil {
+		return nil, fmt.Errorf("%s: %w", args[0], err)
+	}
+	return o, nil
+}
+
+// splitArgs splits a command line into arguments. single and double quotes group words together
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	var quote rune
+	inArg := false
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+func (m *multi) Init() error {
+	if len(m.Outputs) == 0 {
+		return fmt.Errorf("at least one --output is required")
+	}
+	var outs []GenericOutput
+	// the outputs that started are closed again when one of the next ones can't
+	closeStarted := func() {
+		for i, o := range outs {
+			if err := o.Close(); err != nil {
+				log.Errorf("%s: %s", m.Outputs[i], err)
+			}
+		}
+	}
+	for _, spec := range m.Outputs {
+		o, err := newOutputFromSpec(spec)
+		if err != nil {
+			closeStarted()
+			return err
+		}
+		if err := o.Init(); err != nil {
+			closeStarted()
+			return fmt.Errorf("%s: %w", spec, err)
+		}
+		outs = append(outs, o)
+	}
+	m.closed = make(chan error, len(outs))
+	for i, o := range outs {
+		q := make(chan multiItem, m.QueueSize)
+		m.queues = append(m.queues, q)
+		go func(spec string, o GenericOutput) {
+			for item := range q {
+				if item.flushed != nil {
+					err := o.Flush()
+					if err != nil {
+						err = fmt.Errorf("%s: %w", spec, err)
+					}
+					item.flushed <- err
+					continue
+				}
+				o.Send(item.line)
+			}
+			err := o.Close()
+			if err != nil {
+				err = fmt.Errorf("%s: %w", spec, err)
+			}
+			m.closed <- err
+		}(m.Outputs[i], o)
+	}
+	return nil
+}
+
+func (m *multi) Send(line string) {
+	for _, q := range m.queues {
+		q <- multiItem{line: line}
+	}
+}
+
+// Flush waits for every output to send its queue and flush
+func (m *multi) Flush() error {
+	flushed := make(chan error, len(m.queues))
+	for _, q := range m.queues {
+		q <- multiItem{flushed: flushed}
+	}
+	var errs []error
+	for range m.queues {
+		if err := <-flushed; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close waits for every output to send its queue and close, and returns all of their errors
+func (m *multi) Close() error {
+	for _, q := range m.queues {
+		close(q)
+	}
+	var errs []error
+	for range m.queues {
+		if err := <-m.closed; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
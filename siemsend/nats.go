@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// natsOutput publishes each line to a NATS subject, optionally through JetStream to get an
+// acknowledgement for every message
+type natsOutput struct {
+	URL         string
+	Subject     string
+	JetStream   bool
+	AckTimeout  time.Duration
+	MaxPending  int
+	Credentials string
+	Token       string
+	Username    string
+	Password    string
+	UseTLS      bool
+	TLS         tlsOptions
+	conn        *nats.Conn
+	js          nats.JetStreamContext
+	subject     *template.Template
+	failed      *failedLines
+	// pending is the JetStream messages published so far that might still be waiting for an ack
+	pending []nats.PubAckFuture
+}
+
+var natsSubjectFuncs = template.FuncMap{
+	// field looks up a dotted path, for keys that have dots in them or might be missing:
+	// {{field . "host.name"}}
+	"field": getFieldString,
+	"lower": strings.ToLower,
+}
+
+var _ = natsOutput{}.init()
+
+func (n natsOutput) init() error {
+	natsCmd := &cobra.Command{
+		Use:   "nats [arguments]",
+		Short: "send input data to a NATS subject",
+		Long: `each line is published as one message. the subject is a Go text/template executed with the event, e.g.
+--subject 'logs.{{field . "host.name"}}'. with --jetstream every message is acknowledged by the stream.`,
+		Args: cobra.ExactArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			runOutput(&n)
+		},
+	}
+	n.flags(natsCmd.Flags())
+	outputs["nats"] = func(flags *pflag.FlagSet) GenericOutput {
+		o := &natsOutput{}
+		o.flags(flags)
+		return o
+	}
+	rootCmd.AddCommand(natsCmd)
+	return nil
+}
+
+func (n *natsOutput) flags(flags *pflag.FlagSet) {
+	flags.StringVarP(&n.URL, "url", "", nats.DefaultURL, "NATS server URLs, comma separated")
+	flags.StringVarP(&n.Subject, "subject", "", "", "subject to publish to, as a Go text/template of the event")
+	flags.BoolVarP(&n.JetStream, "jetstream", "", false, "publish through JetStream and wait for the acks")
+	flags.DurationVarP(&n.AckTimeout, "ack-timeout", "", 30*time.Second, "how long to wait for the outstanding JetStream acks when closing")
+	flags.IntVarP(&n.MaxPending, "max-pending", "", 256, "maximum number of JetStream messages waiting for an ack")
+	flags.StringVarP(&n.Credentials, "creds", "", "", "NATS credentials file")
+	flags.StringVarP(&n.Token, "token", "", "", "NATS auth token")
+	flags.StringVarP(&n.Username, "username", "", "", "NATS username")
+	flags.StringVarP(&n.Password, "password", "", "", "NATS password")
+	flags.BoolVarP(&n.UseTLS, "tls", "", false, "connect over TLS")
+	n.TLS.flags(flags)
+}
+
+func (n *natsOutput) spoolKey() string {
+	return spoolKey(n.URL, n.Subject)
+}
+
+func (n *natsOutput) Init() error {
+	if n.Subject == "" {
+		return fmt.Errorf("--subject is required")
+	}
+	subject, err := template.New("subject").Funcs(natsSubjectFuncs).Parse(n.Subject)
+	if err != nil {
+		return err
+	}
+	n.subject = subject
+	n.failed = newFailedLines("nats", n.spoolKey())
+
+	opts := []nats.Option{nats.Name("siemsend"), nats.MaxReconnects(-1)}
+	if n.Credentials != "" {
+		opts = append(opts, nats.UserCredentials(n.Credentials))
+	}
+	if n.Token != "" {
+		opts = append(opts, nats.Token(n.Token))
+	}
+	if n.Username != "" {
+		opts = append(opts, nats.UserInfo(n.Username, n.Password))
+	}
+	if n.UseTLS {
+		tlsConfig, err := n.TLS.Config()
+		if err != nil {
+			return err
+		}
+		opts = append(opts, nats.Secure(tlsConfig))
+	}
+	n.conn, err = nats.Connect(n.URL, opts...)
+	if err != nil {
+		return err
+	}
+	if n.JetStream {
+		n.js, err = n.conn.JetStream(
+			nats.PublishAsyncMaxPending(n.MaxPending),
+			nats.PublishAsyncErrHandler(func(_ nats.JetStream, msg *nats.Msg, err error) {
+				log.Errorf("message to %s not acknowledged: %s", msg.Subject, err)
+				n.failed.Add(string(msg.Data))
+			}),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subjectOf renders the subject template with the decoded event
+func (n *natsOutput) subjectOf(line string) (string, error) {
+	var event map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &event); err != nil {
+		event = map[string]interface{}{}
+	}
+	var buf bytes.Buffer
+	if err := n.subject.Execute(&buf, event); err != nil {
+		return "", err
+	}
+	subject := buf.String()
+	if subject == "" || strings.Contains(subject, "..") || strings.HasSuffix(subject, ".") || strings.ContainsAny(subject, " \t") {
+		return "", fmt.Errorf("invalid subject %q", subject)
+	}
+	return subject, nil
+}
+
+func (n *natsOutput) Send(line string) {
+	subject, err := n.subjectOf(line)
+	if err == nil {
+		if n.JetStream {
+			// failed acks are handled by the PublishAsyncErrHandler, missing ones by Close
+			var f nats.PubAckFuture
+			f, err = n.js.PublishAsync(subject, []byte(line))
+			if err == nil {
+				n.pending = append(n.pending, f)
+				if len(n.pending) > 2*n.MaxPending {
+					n.pending = unacked(n.pending)
+				}
+			}
+		} else {
+			err = n.conn.Publish(subject, []byte(line))
+		}
+	}
+	if err != nil {
+		log.Errorf("message not sent: %s", err)
+		n.failed.Add(line)
+		return
+	}
+	// with JetStream the messages that aren't acknowledged later are counted as failed too
+	globalMetrics.sent("nats", 1, len(line))
+}
+
+// unacked returns the messages that have neither an ack nor an error yet
+func unacked(futures []nats.PubAckFuture) []nats.PubAckFuture {
+	waiting := futures[:0]
+	for _, f := range futures {
+		select {
+		case <-f.Ok():
+		case <-f.Err():
+		default:
+			waiting = append(waiting, f)
+		}
+	}
+	return waiting
+}
+
+// Flush waits for the server to have every message, with JetStream for their acks
+func (n *natsOutput) Flush() error {
+	if n.JetStream {
+		select {
+		case <-n.js.PublishAsyncComplete():
+			n.pending = nil
+		case <-time.After(n.AckTimeout):
+			return fmt.Errorf("%d messages still waiting for an ack after %s", n.js.PublishAsyncPending(), n.AckTimeout)
+		}
+	} else if err := n.conn.Flush(); err != nil {
+		return err
+	}
+	n.failed.Flush()
+	return nil
+}
+
+func (n *natsOutput) Close() error {
+	defer n.conn.Close()
+	var err error
+	if n.JetStream {
+		select {
+		case <-n.js.PublishAsyncComplete():
+		case <-time.After(n.AckTimeout):
+			// the messages still waiting are spooled, a late ack makes them arrive twice at worst
+			waiting := unacked(n.pending)
+			for _, f := range waiting {
+				log.Errorf("message to %s not acknowledged after %s", f.Msg().Subject, n.AckTimeout)
+				n.failed.Add(string(f.Msg().Data))
+			}
+			err = fmt.Errorf("%d messages not acknowledged after %s", len(waiting), n.AckTimeout)
+		}
+		n.pending = nil
+	} else {
+		err = n.conn.Flush()
+	}
+	n.failed.Flush()
+	return err
+}
@@ -1,28 +1,50 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
-	"crypto/tls"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/opensearch-project/opensearch-go"
 	"github.com/opensearch-project/opensearch-go/opensearchapi"
+	"github.com/opensearch-project/opensearch-go/opensearchutil"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 type Opensearch struct {
-	Endpoint  string
-	Index     string
-	BatchSize uint
-	Compress  bool
+	Endpoint      []string
+	Index         string
+	BatchSize     uint
+	Compress      bool
+	Username      string
+	Password      string
+	APIKey        string
+	TLS           tlsOptions
+	IDField       string
+	IDHash        bool
+	Workers       int
+	FlushBytes    int
+	FlushInterval time.Duration
+	IndexField    string
+	bi            opensearchutil.BulkIndexer
+	config        opensearchutil.BulkIndexerConfig
+	// stats adds up the bulk indexers closed by Flush
+	stats opensearchutil.BulkIndexerStats
+	// added is the number of documents since the last flush
+	added  uint
+	failed *failedLines
+	errors *bulkErrors
 }
 
 var _ = Opensearch{}.init()
@@ -31,99 +53,258 @@ func (s Opensearch) init() error {
 	OpensearchCmd := &cobra.Command{
 		Use:   "opensearch [arguments]",
 		Short: "send input data to Opensearch",
-		Long:  `make sure your data is in jsonl format, meaning each line is a separate json object.`,
+		Long:  `make sure your data is in jsonl format, meaning each line is a separate json object. They're sent to the _bulk API.`,
 		Args:  cobra.ExactArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
-			s.Send(cmd, args)
+			runOutput(&s)
 		},
 	}
-	flags := OpensearchCmd.Flags()
-	flags.StringVarP(&s.Endpoint, "endpoint", "", "", "endpoint")
-	flags.StringVarP(&s.Index, "index", "", "", "index")
-	flags.UintVarP(&s.BatchSize, "batch_size", "", 100, "batch size")
-	flags.BoolVarP(&s.Compress, "compress", "", false, "compress")
+	s.flags(OpensearchCmd.Flags())
+	outputs["opensearch"] = func(flags *pflag.FlagSet) GenericOutput {
+		o := &Opensearch{}
+		o.flags(flags)
+		return o
+	}
 
 	rootCmd.AddCommand(OpensearchCmd)
 	return nil
 }
 
-func (s Opensearch) Send(cmd *cobra.Command, args []string) {
-	// tr := &http.Transport{
-	// 	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	// }
-	// httpClient := &http.Client{Transport: tr}
+func (s *Opensearch) flags(flags *pflag.FlagSet) {
+	flags.StringSliceVarP(&s.Endpoint, "endpoint", "", []string{}, "endpoint, can be repeated")
+	flags.StringVarP(&s.IndexField, "index-field", "", "", "JSON field that overrides --index per event, e.g. one set by a transform route")
+	flags.StringVarP(&s.Index, "index", "", "", "index")
+	flags.UintVarP(&s.BatchSize, "batch_size", "", 0, "send the documents added so far once there are this many, 0 leaves it to --flush-bytes and --flush-interval")
+	flags.BoolVarP(&s.Compress, "compress", "", false, "compress")
+	flags.StringVarP(&s.Username, "username", "", "", "username for basic auth")
+	flags.StringVarP(&s.Password, "password", "", "", "password for basic auth")
+	flags.StringVarP(&s.APIKey, "api-key", "", "", "base64 encoded API key, sent as an ApiKey authorization header")
+	s.TLS.flags(flags)
+	flags.StringVarP(&s.IDField, "id-field", "", "", "JSON field used as the document ID, so sending the same data twice doesn't duplicate it")
+	flags.BoolVarP(&s.IDHash, "id-hash", "", false, "use the sha256 of each line as the document ID")
+	flags.IntVarP(&s.Workers, "workers", "", 4, "number of concurrent bulk requests")
+	flags.IntVarP(&s.FlushBytes, "flush-bytes", "", 5e+6, "size of each bulk request in bytes")
+	flags.DurationVarP(&s.FlushInterval, "flush-interval", "", 5*time.Second, "send a bulk request at least this often")
+}
+
+func (s *Opensearch) spoolKey() string {
+	return spoolKey(append(append([]string{}, s.Endpoint...), s.Index)...)
+}
 
-	client, err := opensearch.NewClient(opensearch.Config{
+func (s *Opensearch) Init() error {
+	tlsConfig, err := s.TLS.Config()
+	if err != nil {
+		return err
+	}
+	cfg := opensearch.Config{
 		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			TLSClientConfig: tlsConfig,
 		},
-		Addresses: []string{s.Endpoint},
-		Username:  "admin", // For testing only. Don't store credentials in code.
-		Password:  "admin",
-	})
-
+		Addresses:           s.Endpoint,
+		Username:            s.Username,
+		Password:            s.Password,
+		CompressRequestBody: s.Compress,
+		RetryOnStatus:       []int{429, 502, 503, 504},
+		MaxRetries:          int(globalSpool.Retries),
+		RetryBackoff:        globalSpool.backoff,
+	}
+	if s.APIKey != "" {
+		cfg.Header = http.Header{"Authorization": []string{"ApiKey " + s.APIKey}}
+	}
+	client, err := opensearch.NewClient(cfg)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	// ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	// defer cancel()
+	// with only --index-field, every event names its own index
+	if s.Index != "" {
+		if err := s.createIndex(client); err != nil {
+			return err
+		}
+	}
 
+	s.failed = newFailedLines("opensearch", s.spoolKey())
+	s.errors = newBulkErrors()
+	onFlushStart, onError, onFlushEnd := globalMetrics.bulkCallbacks("opensearch")
+	s.config = opensearchutil.BulkIndexerConfig{
+		Index:         s.Index,
+		Client:        client,
+		NumWorkers:    s.Workers,
+		FlushBytes:    s.FlushBytes,
+		FlushInterval: s.FlushInterval,
+		OnError:       onError,
+		OnFlushStart:  onFlushStart,
+		OnFlushEnd:    onFlushEnd,
+	}
+	s.bi, err = opensearchutil.NewBulkIndexer(s.config)
+	if err != nil {
+		return fmt.Errorf("error creating the indexer: %w", err)
+	}
+	return nil
+}
+
+// createIndex creates --index when it doesn't exist yet
+func (s *Opensearch) createIndex(client *opensearch.Client) error {
 	ctx := context.Background()
 
 	// Use the IndexExists service to check if a specified index exists.
-	settings := strings.NewReader(`{
-		'settings': {
-			'index': {
-				'number_of_shards': 1,
-				'number_of_replicas': 0
-				}
-			}
-		}`)
-
-	res, err := opensearchapi.IndicesCreateRequest{
-		Index: s.Index,
-		Body:  settings,
+	exists, err := opensearchapi.IndicesExistsRequest{
+		Index: []string{s.Index},
 	}.Do(ctx, client)
 	if err != nil {
-		log.Warn(err)
+		return err
 	}
-	if res.StatusCode != 201 {
-		log.Warnf("Index creation failed")
-	}
-	scanner := bufio.NewScanner(os.Stdin)
-	buf := make([]byte, 0, 640*1024)
-	scanner.Buffer(buf, 1024*1024*10)
-
-	cnt := 0
-	for scanner.Scan() {
-		cnt++
-		res, err := opensearchapi.IndexRequest{
-			Index:      s.Index,
-			Body:       bytes.NewReader([]byte(scanner.Text())),
-			Refresh:    "false",
-			DocumentID: fmt.Sprintf("%d", cnt),
-			Timeout:    2 * time.Second, //TODO: make it configurable
+	exists.Body.Close()
+	if exists.StatusCode == http.StatusNotFound {
+		res, err := opensearchapi.IndicesCreateRequest{
+			Index: s.Index,
 		}.Do(ctx, client)
 		if err != nil {
-			log.Warn(err)
+			return err
 		}
-		if res.StatusCode != 201 {
-			log.Warnf("insert failed with status code %d", res.StatusCode)
-			log.Infof("the server response: %s", res.String())
+		res.Body.Close()
+		if res.IsError() {
+			// another writer might have created it in the meantime, the bulk requests will tell
+			log.Warnf("Index creation failed: %s", res.Status())
+		} else {
+			log.Infof("Created Index %v", s.Index)
+		}
+	} else if exists.IsError() {
+		return fmt.Errorf("could not check index %s: %s", s.Index, exists.Status())
+	}
+	return nil
+}
+
+// documentID returns the ID of the document in line, or empty to let the cluster pick one
+func (s *Opensearch) documentID(line string) string {
+	if s.IDField != "" {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err == nil {
+			if id := getFieldString(event, s.IDField); id != "" {
+				return id
+			}
 		}
-		// _, err := client.Index().
-		// 	Index(s.Index).
-		// 	Type("_doc").
-		// 	BodyString(scanner.Text()).
-		// 	Do(ctx)
-
-		if cnt%int(s.BatchSize) == 0 {
-			// client.Flush().Index(s.Index).Do(ctx)
-			log.Infoln(cnt)
+	}
+	if s.IDHash {
+		sum := sha256.Sum256([]byte(line))
+		return hex.EncodeToString(sum[:])
+	}
+	return ""
+}
+
+func (s *Opensearch) Send(line string) {
+	err := s.bi.Add(
+		context.Background(),
+		opensearchutil.BulkIndexerItem{
+			Action:     "index",
+			Index:      indexFromField(line, s.IndexField),
+			DocumentID: s.documentID(line),
+			Body:       bytes.NewReader([]byte(line)),
+			OnSuccess: func(ctx context.Context, item opensearchutil.BulkIndexerItem, res opensearchutil.BulkIndexerResponseItem) {
+				globalMetrics.bulkItem(ctx)
+				globalMetrics.sent("opensearch", 1, len(line))
+			},
+			OnFailure: func(ctx context.Context, item opensearchutil.BulkIndexerItem, res opensearchutil.BulkIndexerResponseItem, err error) {
+				globalMetrics.bulkItem(ctx)
+				if err != nil {
+					s.errors.Add(err.Error())
+				} else {
+					s.errors.Add(fmt.Sprintf("%d %s: %s", res.Status, res.Error.Type, res.Error.Reason))
+				}
+				s.failed.Add(line)
+			},
+		},
+	)
+	if err != nil {
+		log.Warn(err)
+		s.failed.Add(line)
+		return
+	}
+
+	// the bulk indexer only goes by size and time, a batch of documents is sent by flushing it
+	if s.added++; s.BatchSize != 0 && s.added >= s.BatchSize {
+		if err := s.Flush(); err != nil {
+			log.Warn(err)
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		log.Println(err)
+}
+
+// closeIndexer closes the bulk indexer, which sends what it has, and adds up its stats
+func (s *Opensearch) closeIndexer() error {
+	err := s.bi.Close(context.Background())
+	stats := s.bi.Stats()
+	s.stats.NumAdded += stats.NumAdded
+	s.stats.NumFlushed += stats.NumFlushed
+	s.stats.NumFailed += stats.NumFailed
+	s.stats.NumIndexed += stats.NumIndexed
+	s.stats.NumCreated += stats.NumCreated
+	s.stats.NumUpdated += stats.NumUpdated
+	s.stats.NumDeleted += stats.NumDeleted
+	s.stats.NumRequests += stats.NumRequests
+	s.failed.Flush()
+	s.added = 0
+	return err
+}
+
+// Flush closes the bulk indexer and starts a new one, it has no other way to send what it has
+func (s *Opensearch) Flush() error {
+	err := s.closeIndexer()
+	bi, newErr := opensearchutil.NewBulkIndexer(s.config)
+	if newErr != nil {
+		return fmt.Errorf("error creating the indexer: %w", newErr)
+	}
+	s.bi = bi
+	return err
+}
+
+func (s *Opensearch) Close() error {
+	err := s.closeIndexer()
+	stats := s.stats
+	log.Infof("opensearch: %d documents added, %d indexed, %d failed in %d requests",
+		stats.NumAdded, stats.NumIndexed+stats.NumCreated+stats.NumUpdated, stats.NumFailed, stats.NumRequests)
+	s.errors.Log("opensearch")
+	if err != nil {
+		return err
+	}
+	if stats.NumFailed > 0 {
+		return fmt.Errorf("%d documents failed to index", stats.NumFailed)
+	}
+	return nil
+}
+
+// bulkErrors counts the per document errors of a bulk indexer by their message, so the summary
+// at the end shows each kind of failure once instead of thousands of identical log lines
+type bulkErrors struct {
+	lock   sync.Mutex
+	counts map[string]uint64
+}
+
+func newBulkErrors() *bulkErrors {
+	return &bulkErrors{counts: make(map[string]uint64)}
+}
+
+func (b *bulkErrors) Add(reason string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	// keep the summary readable when the reason has the document in it
+	if len(reason) > 300 {
+		reason = reason[:300] + "..."
+	}
+	b.counts[reason]++
+}
+
+// Log prints the failures, most common first
+func (b *bulkErrors) Log(name string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	reasons := make([]string, 0, len(b.counts))
+	for r := range b.counts {
+		reasons = append(reasons, r)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		return b.counts[reasons[i]] > b.counts[reasons[j]]
+	})
+	for _, r := range reasons {
+		log.Errorf("%s: %d documents failed with %s", name, b.counts[r], strings.TrimSpace(r))
 	}
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay [output] [arguments]",
+	Short: "send the batches spooled by an output again",
+	Long: `replay reads the files an output wrote to --spool, oldest first, and sends them through the output again.
+a file is deleted only after every line in it is delivered. replay stops at the first file that fails, so the order
+of the spool is kept and the remaining files are left for the next run. each output instance spools to its own
+directory, named after a hash of its endpoints and index or topic, so replay with the same ones it failed with. example:
+siemsend replay --spool /var/spool/siemsend splunk --endpoint https://hec:8088 --token xyz`,
+}
+
+// addReplayCommands adds a replay subcommand for each registered output. it has to run after
+// every output has registered itself, so it's called from main
+func addReplayCommands() {
+	var names []string
+	for name := range outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		name := name
+		replayCmd.AddCommand(&cobra.Command{
+			Use:   name + " [arguments]",
+			Short: "replay the spooled batches of " + name,
+			// the output's flags are parsed by replaySpool, once for each spool file
+			DisableFlagParsing: true,
+			Run: func(cmd *cobra.Command, args []string) {
+				if err := replaySpool(name, args); err != nil {
+					log.Fatal(err)
+				}
+			},
+		})
+	}
+	rootCmd.AddCommand(replayCmd)
+}
+
+// newReplayOutput builds a fresh output from the raw replay arguments. the global flags are
+// parsed along with the output's own since cobra doesn't parse them for replay subcommands
+func newReplayOutput(name string, args []string) (GenericOutput, error) {
+	flags := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	flags.AddFlagSet(rootCmd.PersistentFlags())
+	o := outputs[name](flags)
+	if err := flags.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			os.Exit(0)
+		}
+		return nil, err
+	}
+	return o, nil
+}
+
+func replaySpool(name string, args []string) error {
+	// parse once up front so --spool and the instance's key are known before listing the files
+	o, err := newReplayOutput(name, args)
+	if err != nil {
+		return err
+	}
+	if globalSpool.Dir == "" {
+		return fmt.Errorf("--spool is required")
+	}
+	so, ok := o.(spooledOutput)
+	if !ok {
+		return fmt.Errorf("%s doesn't spool", name)
+	}
+	files, err := globalSpool.files(name, so.spoolKey())
+	if err != nil {
+		return err
+	}
+	log.Infof("%d spooled batches found for %s", len(files), name)
+	globalSpool.replaying = true
+	for _, file := range files {
+		// each file gets its own output, so Close tells us the file was fully delivered
+		o, err := newReplayOutput(name, args)
+		if err != nil {
+			return err
+		}
+		failedBefore := globalSpool.Failed()
+		if err := replayFile(o, file); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if failed := globalSpool.Failed() - failedBefore; failed != 0 {
+			return fmt.Errorf("%s: %d lines failed to deliver, stopping", file, failed)
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		log.Infof("%s replayed", file)
+	}
+	return nil
+}
+
+func replayFile(o GenericOutput, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := o.Init(); err != nil {
+		return err
+	}
+	err = readLines(f, func(line string) bool {
+		o.Send(line)
+		return true
+	})
+	if err := o.Close(); err != nil {
+		return err
+	}
+	return err
+}
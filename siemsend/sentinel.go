@@ -1,51 +1,89 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"compress/gzip"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
 	"net/http"
 	"net/url"
-	"os"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
-func (s Sentinel) Init() error {
+func (s Sentinel) init() error {
 	sentinelCmd := &cobra.Command{
 		Use:   "sentinel [arguments]",
 		Short: "send input data to Microsoft Sentinel",
 		Long:  `make sure your data is in jsonl format, meaning each line is a separate json object. They'll be reconstructed into a JSON array and sent to Microsoft Sentinel.`,
 		Args:  cobra.ExactArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
-			s.Send(cmd, args)
+			runOutput(&s)
 		},
 	}
-	flags := sentinelCmd.Flags()
+	s.flags(sentinelCmd.Flags())
+	outputs["sentinel"] = func(flags *pflag.FlagSet) GenericOutput {
+		o := &Sentinel{}
+		o.flags(flags)
+		return o
+	}
+	rootCmd.AddCommand(sentinelCmd)
+	return nil
+}
+
+func (s *Sentinel) flags(flags *pflag.FlagSet) {
 	flags.StringVarP(&s.CustomerId, "customer_id", "", "", "customer id")
 	flags.StringVarP(&s.SharedKey, "shared_key", "", "", "shared key")
 	flags.StringVarP(&s.LogType, "log_type", "", "", "log type")
-	flags.UintVarP(&s.BatchSize, "batch_size", "", 100, "batch size")
+	flags.StringVarP(&s.LogTypeField, "log_type_field", "", "", "JSON field that overrides log_type per event, e.g. one set by a transform route")
+	flags.UintVarP(&s.BatchSize, "batch_size", "", 100, "maximum number of events in a batch")
+	flags.IntVarP(&s.BatchBytes, "batch_bytes", "", 25*1024*1024, "maximum size of a batch in bytes, before compression. the API takes up to 30MB per request")
+	flags.DurationVarP(&s.FlushInterval, "flush_interval", "", 5*time.Second, "send a batch at least this often, even if it's not full")
+	flags.IntVarP(&s.Workers, "workers", "", 4, "number of batches sent at the same time")
 	flags.StringVarP(&s.Proxy, "proxy", "", "", "proxy url")
-	flags.BoolVarP(&s.Compression, "compression", "", false, "compression")
-	rootCmd.AddCommand(sentinelCmd)
-	return nil
+	flags.BoolVarP(&s.Compression, "compression", "", false, "gzip the requests")
+	flags.StringVarP(&s.Endpoint, "endpoint", "", "", "Data Collector API URL, https://<customer_id>.ods.opinsights.azure.com by default. for sovereign clouds")
 }
 
 type Sentinel struct {
-	CustomerId  string
-	SharedKey   string
-	LogType     string
-	BatchSize   uint
-	Proxy       string
-	Compression bool
+	CustomerId    string
+	SharedKey     string
+	LogType       string
+	LogTypeField  string
+	BatchSize     uint
+	BatchBytes    int
+	FlushInterval time.Duration
+	Workers       int
+	Proxy         string
+	Compression   bool
+	Endpoint      string
+	client        *http.Client
+	lock          *sync.Mutex
+	// batches are kept per log type, since each request goes to a single table
+	batches map[string]*sentinelBatch
+	queue   chan *sentinelBatch
+	wg      *sync.WaitGroup
+	// inflight is the batches queued and not sent or spooled yet
+	inflight *sync.WaitGroup
+	done     chan struct{}
+}
+
+// sentinelBatch is the events of one log type waiting to be sent
+type sentinelBatch struct {
+	logType string
+	lines   []string
+	// size is the size of the JSON array the lines make
+	size int
 }
 
 type SignatureElements struct {
@@ -57,7 +95,7 @@ type SignatureElements struct {
 }
 
 // initializing and starting the sentinel object means the flags will be populated just in time
-var _ = Sentinel{}.Init()
+var _ = Sentinel{}.init()
 
 func (s Sentinel) buildSignature(sig SignatureElements) (string, error) {
 	// build HMAC signature
@@ -84,112 +122,222 @@ x-ms-date:{{.Date}}
 	return signature, nil
 }
 
-func (s Sentinel) sendBatch(batch string, totalSize uint) {
+// sendBatch sends a batch, retrying with backoff. its lines are spooled if it can't be delivered
+func (s *Sentinel) sendBatch(b *sentinelBatch) {
+	var body bytes.Buffer
+	body.Grow(b.size)
+	body.WriteByte('[')
+	for i, l := range b.lines {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		body.WriteString(l)
+	}
+	body.WriteByte(']')
+	payload := body.Bytes()
+	if s.Compression {
+		var gz bytes.Buffer
+		w := gzip.NewWriter(&gz)
+		w.Write(payload)
+		w.Close()
+		payload = gz.Bytes()
+	}
+	err := globalSpool.retry("sentinel", func() error {
+		return s.postBatch(b.logType, payload)
+	})
+	if err != nil {
+		log.Errorf("batch not sent: %s", err)
+		globalSpool.Write("sentinel", s.spoolKey(), b.lines)
+		return
+	}
+	globalMetrics.sent("sentinel", len(b.lines), b.size)
+}
+
+func (s *Sentinel) postBatch(logType string, body []byte) error {
 	// send batch to Microsoft Sentinel
 	// build signature
 	location, _ := time.LoadLocation("GMT")
 	signatureElemets := SignatureElements{
 		Date:          time.Now().In(location).Format(time.RFC1123),
 		Method:        "POST",
-		ContentLength: totalSize,
+		ContentLength: uint(len(body)),
 		ContentType:   "application/json",
 		Resource:      "/api/logs",
 	}
 	signature, err := s.buildSignature(signatureElemets)
 	if err != nil {
-		PrintBatch(batch)
-		log.Error(err)
-		return
+		return permanentError{err}
 	}
 	// build request
-	uri := "https://" + s.CustomerId + ".ods.opinsights.azure.com" + signatureElemets.Resource + "?api-version=2016-04-01"
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + s.CustomerId + ".ods.opinsights.azure.com"
+	}
+	uri := strings.TrimSuffix(endpoint, "/") + signatureElemets.Resource + "?api-version=2016-04-01"
 	headers := map[string]string{
 		"x-ms-date":     signatureElemets.Date,
 		"content-type":  signatureElemets.ContentType,
 		"Authorization": signature,
-		"Log-Type":      s.LogType,
+		"Log-Type":      logType,
+	}
+	if s.Compression {
+		headers["Content-Encoding"] = "gzip"
 	}
 	// send request
-	req, err := http.NewRequest("POST", uri, bytes.NewBuffer([]byte(batch)))
+	req, err := http.NewRequest("POST", uri, bytes.NewReader(body))
 	if err != nil {
-		PrintBatch(batch)
-		log.Error(err)
-		return
+		return permanentError{err}
 	}
-	var res *http.Response
-
 	for k, v := range headers {
 		req.Header[k] = []string{v}
 	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		log.Infof("batch sent, with code %d", res.StatusCode)
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	err = fmt.Errorf("batch not sent, with code %d: %s", res.StatusCode, bytes.TrimSpace(msg))
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+		return retryAfterError{err: err, after: parseRetryAfter(res.Header.Get("Retry-After"))}
+	}
+	// the rest of the 4xx, like a bad signature, won't get better by retrying
+	return permanentError{err}
+}
+
+func (s *Sentinel) spoolKey() string {
+	return spoolKey(s.Endpoint, s.CustomerId, s.LogType)
+}
+
+func (s *Sentinel) Init() error {
+	if s.BatchSize == 0 {
+		s.BatchSize = 1
+	}
+	if s.Workers < 1 {
+		s.Workers = 1
+	}
+	tr := &http.Transport{}
 	if s.Proxy != "" {
 		proxyURL, err := url.Parse(s.Proxy)
 		if err != nil {
-			PrintBatch(batch)
-			log.Error(err)
-			return
+			return err
 		}
-		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
-		res, err = client.Do(req)
-		if err != nil {
-			PrintBatch(batch)
-			log.Error(err)
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
+	s.client = &http.Client{Timeout: time.Minute, Transport: tr}
+	s.lock = &sync.Mutex{}
+	s.wg = &sync.WaitGroup{}
+	s.inflight = &sync.WaitGroup{}
+	s.batches = make(map[string]*sentinelBatch)
+	s.queue = make(chan *sentinelBatch, s.Workers)
+	s.done = make(chan struct{})
+	for i := 0; i < s.Workers; i++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for b := range s.queue {
+				s.sendBatch(b)
+				s.inflight.Done()
+			}
+		}()
+	}
+	if s.FlushInterval > 0 {
+		go s.flushEvery(s.FlushInterval)
+	}
+	return nil
+}
+
+// flushEvery sends the batches that aren't full yet, so quiet log types aren't held back
+func (s *Sentinel) flushEvery(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.done:
 			return
+		case <-tick.C:
 		}
-	} else {
-		// command, _ := http2curl.GetCurlCommand(req)
-		// fmt.Println(command)
-		res, err = http.DefaultClient.Do(req)
-		if err != nil {
-			PrintBatch(batch)
-			log.Error(err)
-			return
+		s.lock.Lock()
+		for logType, b := range s.batches {
+			delete(s.batches, logType)
+			s.enqueue(b)
 		}
+		s.lock.Unlock()
 	}
-	if res.StatusCode >= 200 && res.StatusCode < 300 {
-		log.Infof("batch sent, with code %d", res.StatusCode)
-	} else {
-		log.Errorf("batch not sent, with code %d", res.StatusCode)
-		PrintBatch(batch)
+}
+
+func (s *Sentinel) Send(line string) {
+	// one bad line would make the API reject the whole batch
+	if !json.Valid([]byte(line)) {
+		log.Errorf("sentinel: skipping line that is not valid JSON")
+		globalSpool.Write("sentinel", s.spoolKey(), []string{line})
+		return
+	}
+	// 2 bytes for the brackets of the array
+	if 2+len(line) > s.BatchBytes {
+		log.Errorf("sentinel: event of %d bytes is larger than batch_bytes", len(line))
+		globalSpool.Write("sentinel", s.spoolKey(), []string{line})
+		return
+	}
+	logType := s.LogType
+	if t := indexFromField(line, s.LogTypeField); t != "" {
+		logType = t
 	}
 
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b, ok := s.batches[logType]
+	// one comma between each event
+	if ok && b.size+1+len(line) > s.BatchBytes {
+		s.enqueue(b)
+		ok = false
+	}
+	if !ok {
+		b = &sentinelBatch{logType: logType, size: 2}
+		s.batches[logType] = b
+	}
+	if len(b.lines) > 0 {
+		b.size++
+	}
+	b.lines = append(b.lines, line)
+	b.size += len(line)
+	if len(b.lines) >= int(s.BatchSize) {
+		delete(s.batches, logType)
+		s.enqueue(b)
+	}
 }
 
-// this is used when an error accours, and we want to send the batch to stdout
-func PrintBatch(batch string) {
-	batch = strings.TrimSuffix(batch, "]")
-	batch = strings.TrimPrefix(batch, "[")
-	batch = strings.ReplaceAll(batch, "},{", "}\n{")
-	// send the failed batch to stdout
-	fmt.Printf("%s\n", batch)
+// enqueue hands a batch to the workers, call it with the lock held
+func (s *Sentinel) enqueue(b *sentinelBatch) {
+	s.inflight.Add(1)
+	s.queue <- b
 }
 
-func (s Sentinel) Send(cmd *cobra.Command, args []string) {
-	// todo: build the send function and for loop
-	batch := "["
-	cnt := 0
+// Flush queues the batches that aren't full yet and waits for every queued batch to be sent
+func (s *Sentinel) Flush() error {
+	s.lock.Lock()
+	for logType, b := range s.batches {
+		delete(s.batches, logType)
+		s.enqueue(b)
+	}
+	s.lock.Unlock()
+	s.inflight.Wait()
+	return nil
+}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	for {
-		if scanner.Scan() {
-			cnt++
-			batch += scanner.Text()
-			batch += ","
-			if cnt == int(s.BatchSize) {
-				// remove the last ,
-				batch = strings.TrimSuffix(batch, ",")
-				batch += "]"
-				s.sendBatch(batch, uint(len(batch)))
-				//reset counters
-				batch = "["
-				cnt = 0
-			}
-		} else {
-			if batch != "[" {
-				batch = strings.TrimSuffix(batch, ",")
-				batch += "]"
-				s.sendBatch(batch, uint(len(batch)))
-			}
-			break
-		}
+func (s *Sentinel) Close() error {
+	close(s.done)
+	s.lock.Lock()
+	for _, b := range s.batches {
+		s.enqueue(b)
 	}
+	s.batches = nil
+	s.lock.Unlock()
+	close(s.queue)
+	s.wg.Wait()
+	return nil
 }
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// dcrMaxRequestSize is the largest request body the Logs Ingestion API accepts
+const dcrMaxRequestSize = 1024 * 1024
+
+// sentinelDCR sends events to the Azure Monitor Logs Ingestion API through a data collection
+// endpoint (DCE) and rule (DCR). it replaces the HTTP Data Collector API used by sentinel
+type sentinelDCR struct {
+	Endpoint     string
+	DCRID        string
+	Stream       string
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+	TokenURL     string
+	Scope        string
+	APIVersion   string
+	BatchSize    uint
+	Proxy        string
+	client       *http.Client
+	token        *oauthToken
+	batch        []string
+	size         int
+}
+
+var _ = sentinelDCR{}.init()
+
+func (s sentinelDCR) init() error {
+	dcrCmd := &cobra.Command{
+		Use:   "sentinel-dcr [arguments]",
+		Short: "send input data to Microsoft Sentinel using the Logs Ingestion API",
+		Long:  `make sure your data is in jsonl format, meaning each line is a separate json object. They'll be reconstructed into a JSON array and sent to the stream of a data collection rule, in requests of up to 1MB.`,
+		Args:  cobra.ExactArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			runOutput(&s)
+		},
+	}
+	s.flags(dcrCmd.Flags())
+	outputs["sentinel-dcr"] = func(flags *pflag.FlagSet) GenericOutput {
+		o := &sentinelDCR{}
+		o.flags(flags)
+		return o
+	}
+	rootCmd.AddCommand(dcrCmd)
+	return nil
+}
+
+func (s *sentinelDCR) flags(flags *pflag.FlagSet) {
+	flags.StringVarP(&s.Endpoint, "endpoint", "", "", "data collection endpoint URL, e.g. https://my-dce-abcd.eastus-1.ingest.monitor.azure.com")
+	flags.StringVarP(&s.DCRID, "dcr-id", "", "", "immutable ID of the data collection rule, e.g. dcr-0123456789abcdef")
+	flags.StringVarP(&s.Stream, "stream", "", "", "stream name in the data collection rule, e.g. Custom-MyTable_CL")
+	flags.StringVarP(&s.TenantID, "tenant-id", "", "", "Entra ID tenant of the app registration")
+	flags.StringVarP(&s.ClientID, "client-id", "", "", "application (client) ID")
+	flags.StringVarP(&s.ClientSecret, "client-secret", "", "", "client secret")
+	flags.StringVarP(&s.TokenURL, "token-url", "", "", "OAuth2 token endpoint (default https://login.microsoftonline.com/<tenant-id>/oauth2/v2.0/token)")
+	flags.StringVarP(&s.Scope, "scope", "", "https://monitor.azure.com//.default", "OAuth2 scope")
+	flags.StringVarP(&s.APIVersion, "api-version", "", "2023-01-01", "Logs Ingestion API version")
+	flags.UintVarP(&s.BatchSize, "batch-size", "", 100, "maximum number of events in each request")
+	flags.StringVarP(&s.Proxy, "proxy", "", "", "proxy url")
+}
+
+func (s *sentinelDCR) spoolKey() string {
+	return spoolKey(s.Endpoint, s.DCRID, s.Stream)
+}
+
+func (s *sentinelDCR) Init() error {
+	if s.Endpoint == "" || s.DCRID == "" || s.Stream == "" {
+		return fmt.Errorf("--endpoint, --dcr-id and --stream are required")
+	}
+	if s.ClientID == "" || s.ClientSecret == "" {
+		return fmt.Errorf("--client-id and --client-secret are required")
+	}
+	if s.TokenURL == "" {
+		if s.TenantID == "" {
+			return fmt.Errorf("--tenant-id or --token-url is required")
+		}
+		s.TokenURL = fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", s.TenantID)
+	}
+	if s.BatchSize == 0 {
+		s.BatchSize = 1
+	}
+	tr := &http.Transport{}
+	if s.Proxy != "" {
+		proxyURL, err := url.Parse(s.Proxy)
+		if err != nil {
+			return err
+		}
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
+	s.client = &http.Client{Timeout: time.Second * 30, Transport: tr}
+	s.token = &oauthToken{
+		client:       s.client,
+		TokenURL:     s.TokenURL,
+		ClientID:     s.ClientID,
+		ClientSecret: s.ClientSecret,
+		Scope:        s.Scope,
+	}
+	// fail early on bad credentials instead of on the first batch
+	_, err := s.token.Get()
+	return err
+}
+
+func (s *sentinelDCR) Send(line string) {
+	if !json.Valid([]byte(line)) {
+		log.Errorf("sentinel-dcr: skipping line that is not valid JSON")
+		globalSpool.Write("sentinel-dcr", s.spoolKey(), []string{line})
+		return
+	}
+	// 2 bytes for the brackets of the array, one comma between each event
+	if 2+len(line) > dcrMaxRequestSize {
+		log.Errorf("sentinel-dcr: event of %d bytes is larger than the 1MB request limit", len(line))
+		globalSpool.Write("sentinel-dcr", s.spoolKey(), []string{line})
+		return
+	}
+	if len(s.batch) > 0 && 2+s.size+len(s.batch)+len(line) > dcrMaxRequestSize {
+		s.sendBatch()
+	}
+	s.batch = append(s.batch, line)
+	s.size += len(line)
+	if len(s.batch) >= int(s.BatchSize) {
+		s.sendBatch()
+	}
+}
+
+func (s *sentinelDCR) sendBatch() {
+	if len(s.batch) == 0 {
+		return
+	}
+	defer func() {
+		s.batch = nil
+		s.size = 0
+	}()
+	body := []byte("[" + strings.Join(s.batch, ",") + "]")
+	err := globalSpool.retry("sentinel-dcr", func() error {
+		return s.postBatch(body)
+	})
+	if err != nil {
+		log.Errorf("batch not sent: %s", err)
+		globalSpool.Write("sentinel-dcr", s.spoolKey(), s.batch)
+		return
+	}
+	globalMetrics.sent("sentinel-dcr", len(s.batch), s.size)
+}
+
+func (s *sentinelDCR) postBatch(body []byte) error {
+	token, err := s.token.Get()
+	if err != nil {
+		return err
+	}
+	uri := fmt.Sprintf("%s/dataCollectionRules/%s/streams/%s?api-version=%s",
+		strings.TrimSuffix(s.Endpoint, "/"), url.PathEscape(s.DCRID), url.PathEscape(s.Stream), url.QueryEscape(s.APIVersion))
+	req, err := http.NewRequest("POST", uri, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		log.Infof("batch sent, with code %d", res.StatusCode)
+		return nil
+	}
+	err = fmt.Errorf("batch not sent, with code %d: %s", res.StatusCode, bytes.TrimSpace(resBody))
+	switch {
+	case res.StatusCode == http.StatusUnauthorized:
+		// the token might have been revoked before it expired, get a new one on the next try
+		s.token.Reset()
+		return err
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return retryAfterError{err: err, after: parseRetryAfter(res.Header.Get("Retry-After"))}
+	}
+	// the rest of the 4xx, like a batch the DCR rejects or one that's too large, won't get better by retrying
+	return permanentError{err}
+}
+
+func (s *sentinelDCR) Flush() error {
+	s.sendBatch()
+	return nil
+}
+
+func (s *sentinelDCR) Close() error {
+	s.sendBatch()
+	return nil
+}
+
+// oauthToken gets and caches an access token using the OAuth2 client credentials flow.
+// the token is refreshed a minute before it expires
+type oauthToken struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scope        string
+	client       *http.Client
+	lock         sync.Mutex
+	token        string
+	expiry       time.Time
+}
+
+func (t *oauthToken) Get() (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.token != "" && time.Now().Add(time.Minute).Before(t.expiry) {
+		return t.token, nil
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {t.ClientID},
+		"client_secret": {t.ClientSecret},
+		"scope":         {t.Scope},
+	}
+	res, err := t.client.PostForm(t.TokenURL, form)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed with code %d: %s", res.StatusCode, body)
+	}
+	var tokenRes struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tokenRes); err != nil {
+		return "", err
+	}
+	if tokenRes.AccessToken == "" {
+		return "", fmt.Errorf("token response has no access_token")
+	}
+	expiresIn, err := tokenRes.ExpiresIn.Int64()
+	if err != nil {
+		// assume the usual lifetime of an Entra ID token
+		expiresIn = 3600
+	}
+	t.token = tokenRes.AccessToken
+	t.expiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	log.Infof("new access token, valid until %s", t.expiry.Format(time.RFC3339))
+	return t.token, nil
+}
+
+// Reset drops the cached token so the next Get requests a new one
+func (t *oauthToken) Reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.token = ""
+}
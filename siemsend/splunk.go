@@ -1,31 +1,43 @@
 package main
 
 import (
-	"bufio"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"net/url"
-	"os"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 
 	"github.com/mosajjal/Go-Splunk-HTTP/splunk/v2"
 )
 
 type splunkConfig struct {
-	Endpoint      []string
-	SkipTLSVerify bool
-	Token         string
-	Index         string
-	Proxy         string
-	Source        string
-	SourceType    string
-	connections   map[string]splunkConnection
+	Endpoint        []string
+	SkipTLSVerify   bool
+	Token           string
+	Index           string
+	Proxy           string
+	Source          string
+	SourceType      string
+	BatchSize       uint
+	Balance         string
+	IndexField      string
+	SourceField     string
+	SourceTypeField string
+	proxy           *url.URL
+	connections     map[string]splunkConnection
+	lock            *sync.RWMutex
+	next            int
+	batch           []*splunk.Event
+	lines           []string
+	done            chan struct{}
 }
 
 type splunkConnection struct {
@@ -34,17 +46,27 @@ type splunkConnection struct {
 	Err       error
 }
 
-func (c splunkConfig) Init() error {
+func (c splunkConfig) init() error {
 	splunkCmd := &cobra.Command{
 		Use:   "splunk [arguments]",
 		Short: "send input data to SplunkHEC",
-		Long:  `make sure your data is in jsonl format, meaning each line is a separate json object. They'll be reconstructed into a JSON array and sent to Microsoft Sentinel.`,
+		Long:  `make sure your data is in jsonl format, meaning each line is a separate json object. They'll be batched and sent to Splunk HTTP Event Collector, load balanced across the endpoints.`,
 		Args:  cobra.ExactArgs(0),
 		Run: func(_ *cobra.Command, _ []string) {
-			c.Output()
+			runOutput(&c)
 		},
 	}
-	flags := splunkCmd.Flags()
+	c.flags(splunkCmd.Flags())
+	outputs["splunk"] = func(flags *pflag.FlagSet) GenericOutput {
+		o := &splunkConfig{}
+		o.flags(flags)
+		return o
+	}
+	rootCmd.AddCommand(splunkCmd)
+	return nil
+}
+
+func (c *splunkConfig) flags(flags *pflag.FlagSet) {
 	flags.StringSliceVarP(&c.Endpoint, "endpoint", "e", []string{}, "Splunk HEC endpoint")
 	flags.BoolVarP(&c.SkipTLSVerify, "skip-tls-verify", "k", false, "Skip TLS verification")
 	flags.StringVarP(&c.Token, "token", "t", "", "Splunk HEC token")
@@ -52,13 +74,17 @@ func (c splunkConfig) Init() error {
 	flags.StringVarP(&c.Proxy, "proxy", "p", "", "Proxy URL")
 	flags.StringVarP(&c.Source, "source", "s", "", "Splunk source")
 	flags.StringVarP(&c.SourceType, "sourcetype", "y", "", "Splunk sourcetype")
-	c.connections = make(map[string]splunkConnection)
-	rootCmd.AddCommand(splunkCmd)
-	return nil
+	flags.UintVarP(&c.BatchSize, "batch-size", "b", 100, "Number of events sent in each HEC request")
+	flags.StringVarP(&c.Balance, "balance", "", "roundrobin", "How to pick an endpoint for each batch: roundrobin or random")
+	flags.StringVarP(&c.IndexField, "index-field", "", "", "JSON field that overrides the Splunk index per event")
+	flags.StringVarP(&c.SourceField, "source-field", "", "", "JSON field that overrides the Splunk source per event")
+	flags.StringVarP(&c.SourceTypeField, "sourcetype-field", "", "", "JSON field that overrides the Splunk sourcetype per event")
 }
 
 func (c splunkConfig) connectMultiSplunkRetry() {
 	for _, splunkEndpoint := range c.Endpoint {
+		// connect once up front so the first batch has somewhere to go
+		c.setConnection(splunkEndpoint, c.connectSplunk(splunkEndpoint))
 		go c.connectSplunkRetry(splunkEndpoint)
 	}
 }
@@ -67,30 +93,46 @@ func (c splunkConfig) connectSplunkRetry(splunkEndpoint string) {
 	tick := time.NewTicker(5 * time.Second)
 	// don't retry connection if we're doing dry run
 	defer tick.Stop()
-	for range tick.C {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-tick.C:
+		}
 		// check to see if the connection exists
-		if conn, ok := c.connections[splunkEndpoint]; ok {
-			if conn.Unhealthy != 0 {
-				log.Warnf("Connection is unhealthy")
-				c.connections[splunkEndpoint] = c.connectSplunk(splunkEndpoint)
-			}
+		c.lock.RLock()
+		conn, ok := c.connections[splunkEndpoint]
+		c.lock.RUnlock()
+		if ok && conn.Unhealthy == 0 {
+			continue
+		}
+		if ok {
+			log.Warnf("Connection to %s is unhealthy: %s", splunkEndpoint, conn.Err)
 		} else {
 			log.Warnf("new splunk endpoint %s", splunkEndpoint)
-			c.connections[splunkEndpoint] = c.connectSplunk(splunkEndpoint)
 		}
+		c.setConnection(splunkEndpoint, c.connectSplunk(splunkEndpoint))
 	}
 }
 
+// setConnection stores a new connection to an endpoint and updates its health metric
+func (c splunkConfig) setConnection(splunkEndpoint string, conn splunkConnection) {
+	c.lock.Lock()
+	c.connections[splunkEndpoint] = conn
+	c.lock.Unlock()
+	up := 1.0
+	if conn.Unhealthy != 0 {
+		up = 0
+	}
+	globalMetrics.endpointUp.WithLabelValues("splunk", splunkEndpoint).Set(up)
+}
+
 func (c splunkConfig) connectSplunk(splunkEndpoint string) splunkConnection {
 	tr := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: c.SkipTLSVerify}}
 	httpClient := &http.Client{Timeout: time.Second * 20, Transport: tr}
 
-	if c.Proxy != "" {
-		proxyURL, err := url.Parse(c.Proxy)
-		if err != nil {
-			panic(err)
-		}
-		httpClient.Transport = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	if c.proxy != nil {
+		tr.Proxy = http.ProxyURL(c.proxy)
 	}
 
 	splunkURL := splunkEndpoint
@@ -113,23 +155,168 @@ func (c splunkConfig) connectSplunk(splunkEndpoint string) splunkConnection {
 		unhealthy++
 	}
 	myConn := splunkConnection{Client: client, Unhealthy: unhealthy, Err: err}
-	log.Warnf("new splunk connection")
+	log.Warnf("new splunk connection to %s", splunkEndpoint)
 	return myConn
 }
 
-func (c splunkConfig) Output() {
+// markUnhealthy flags a connection after a failed request, connectSplunkRetry will reconnect it
+func (c *splunkConfig) markUnhealthy(splunkEndpoint string, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	conn := c.connections[splunkEndpoint]
+	conn.Unhealthy++
+	conn.Err = err
+	c.connections[splunkEndpoint] = conn
+	globalMetrics.endpointUp.WithLabelValues("splunk", splunkEndpoint).Set(0)
+}
+
+// health fails when none of the endpoints is healthy, used by /healthz
+func (c *splunkConfig) health() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, e := range c.Endpoint {
+		if conn, ok := c.connections[e]; ok && conn.Unhealthy == 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("splunk: all %d endpoints are unhealthy", len(c.Endpoint))
+}
+
+// healthyEndpoints returns the endpoints to try for the next batch, in the order they should be tried
+func (c *splunkConfig) healthyEndpoints() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	var healthy []string
+	for _, e := range c.Endpoint {
+		if conn, ok := c.connections[e]; ok && conn.Unhealthy == 0 {
+			healthy = append(healthy, e)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	start := 0
+	if c.Balance == "random" {
+		start = rand.Intn(len(healthy))
+	} else {
+		start = c.next % len(healthy)
+		c.next++
+	}
+	return append(healthy[start:], healthy[:start]...)
+}
+
+func (c *splunkConfig) spoolKey() string {
+	return spoolKey(append(append([]string{}, c.Endpoint...), c.Index)...)
+}
+
+func (c *splunkConfig) Init() error {
+	if len(c.Endpoint) == 0 {
+		return fmt.Errorf("at least one --endpoint is required")
+	}
+	if c.Balance != "roundrobin" && c.Balance != "random" {
+		return fmt.Errorf("unknown balance mode %s", c.Balance)
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = 1
+	}
+	if c.Proxy != "" {
+		proxyURL, err := url.Parse(c.Proxy)
+		if err != nil {
+			return err
+		}
+		c.proxy = proxyURL
+	}
+	c.connections = make(map[string]splunkConnection)
+	c.lock = &sync.RWMutex{}
+	c.done = make(chan struct{})
 
 	log.Infof("Connecting to Splunk endpoints")
 	c.connectMultiSplunkRetry()
+	globalMetrics.addCheck(c.health)
+	return nil
+}
 
-	rand.Seed(time.Now().Unix())
+func (c *splunkConfig) Send(line string) {
+	source, sourceType, index := c.Source, c.SourceType, c.Index
+	if c.IndexField != "" || c.SourceField != "" || c.SourceTypeField != "" {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err == nil {
+			if c.IndexField != "" {
+				if v := getFieldString(event, c.IndexField); v != "" {
+					index = v
+				}
+			}
+			if c.SourceField != "" {
+				if v := getFieldString(event, c.SourceField); v != "" {
+					source = v
+				}
+			}
+			if c.SourceTypeField != "" {
+				if v := getFieldString(event, c.SourceTypeField); v != "" {
+					sourceType = v
+				}
+			}
+		}
+	}
+	e := &splunk.Event{
+		Time:       splunk.EventTime{Time: time.Now()},
+		Source:     source,
+		SourceType: sourceType,
+		Index:      index,
+		Event:      json.RawMessage(line),
+	}
+	c.batch = append(c.batch, e)
+	c.lines = append(c.lines, line)
+	if len(c.batch) >= int(c.BatchSize) {
+		c.sendBatch()
+	}
+}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	for {
-		if scanner.Scan() {
+// sendBatch sends the batch with retries, spooling it if no endpoint accepts it
+func (c *splunkConfig) sendBatch() {
+	if len(c.batch) == 0 {
+		return
+	}
+	defer func() {
+		c.batch = nil
+		c.lines = nil
+	}()
+	if err := globalSpool.retry("splunk", c.postBatch); err != nil {
+		log.Errorf("batch not sent: %s", err)
+		globalSpool.Write("splunk", c.spoolKey(), c.lines)
+	}
+}
+
+// postBatch tries each healthy endpoint in turn until one of them accepts the batch
+func (c *splunkConfig) postBatch() error {
+	for _, e := range c.healthyEndpoints() {
+		c.lock.RLock()
+		client := c.connections[e].Client
+		c.lock.RUnlock()
+		for _, ev := range c.batch {
+			ev.Host = client.Hostname
+		}
+		err := client.LogEvents(c.batch)
+		if err == nil {
+			log.Infof("batch of %d events sent to %s", len(c.batch), e)
+			globalMetrics.sent("splunk", len(c.lines), linesSize(c.lines))
+			return nil
 		}
+		log.Errorf("batch not sent to %s: %s", e, err)
+		c.markUnhealthy(e, err)
 	}
+	return fmt.Errorf("no healthy splunk endpoint accepted the batch")
+}
 
+func (c *splunkConfig) Flush() error {
+	c.sendBatch()
+	return nil
+}
+
+func (c *splunkConfig) Close() error {
+	c.sendBatch()
+	close(c.done)
+	return nil
 }
 
-var _ = splunkConfig{}.Init()
+var _ = splunkConfig{}.init()
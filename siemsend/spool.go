@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// spool is where every output puts the lines it failed to deliver after running out of retries.
+// with --spool set they're written to DIR/<output>/<key>/ as JSONL files for siemsend replay to pick
+// up later, without it they're printed to stdout like before
+type spool struct {
+	Dir        string
+	Retries    uint
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	lock       sync.Mutex
+	seq        uint64
+	// replaying is set by siemsend replay. failed lines are only counted, the spool file
+	// being replayed stays on disk until every line in it is delivered
+	replaying bool
+	failed    uint64
+}
+
+var globalSpool = &spool{}
+
+var _ = globalSpool.init()
+
+func (s *spool) init() error {
+	flags := rootCmd.PersistentFlags()
+	flags.StringVarP(&s.Dir, "spool", "", "", "directory to write batches that failed to deliver, drain it with siemsend replay. failed batches go to stdout if empty")
+	flags.UintVarP(&s.Retries, "retries", "", 3, "number of times a failed batch is retried before it's spooled")
+	flags.DurationVarP(&s.Backoff, "retry-backoff", "", time.Second, "delay before the first retry, doubled on every retry after that")
+	flags.DurationVarP(&s.MaxBackoff, "retry-max-backoff", "", 30*time.Second, "upper limit of the delay between retries")
+	return nil
+}
+
+// backoff returns the delay before retry number attempt (starting at 1), with some jitter
+// so outputs that failed together don't retry together
+func (s *spool) backoff(attempt int) time.Duration {
+	d := s.Backoff
+	for i := 1; i < attempt && d < s.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.MaxBackoff {
+		d = s.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfterError is returned by fn when the server said how long to wait, e.g. with a Retry-After header
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e retryAfterError) Error() string { return e.err.Error() }
+func (e retryAfterError) Unwrap() error { return e.err }
+
+// permanentError is returned by fn when retrying won't help, like a 400 Bad Request
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// retry calls fn until it succeeds or the retries run out, returning the last error
+func (s *spool) retry(name string, fn func() error) error {
+	err := s.attempt(name, fn)
+	for attempt := 1; err != nil && attempt <= int(s.Retries); attempt++ {
+		var permanent permanentError
+		if errors.As(err, &permanent) {
+			break
+		}
+		d := s.backoff(attempt)
+		var after retryAfterError
+		if errors.As(err, &after) && after.after > 0 {
+			d = after.after
+		}
+		log.Warnf("%s: %s, retrying in %s (%d/%d)", name, err, d, attempt, s.Retries)
+		time.Sleep(d)
+		globalMetrics.retries.WithLabelValues(name).Inc()
+		err = s.attempt(name, fn)
+	}
+	globalMetrics.batch(name, err)
+	return err
+}
+
+// attempt calls fn once and records how long it took
+func (s *spool) attempt(name string, fn func() error) error {
+	defer globalMetrics.request(name, time.Now())
+	return fn()
+}
+
+// spooledOutput is implemented by the outputs that spool. spoolKey tells the instances of an
+// output apart, so two splunk outputs of multi don't replay each other's batches
+type spooledOutput interface {
+	spoolKey() string
+}
+
+// spoolKey is a short hash of where an output instance delivers to, its endpoints and index or topic
+func spoolKey(targets ...string) string {
+	h := sha256.Sum256([]byte(strings.Join(targets, "\n")))
+	return hex.EncodeToString(h[:6])
+}
+
+// Write stores lines that output name couldn't deliver, key is the output's spoolKey
+func (s *spool) Write(name, key string, lines []string) {
+	globalMetrics.failed.WithLabelValues(name).Add(float64(len(lines)))
+	s.store(name, key, lines)
+}
+
+// store is Write for lines that are already counted as failed
+func (s *spool) store(name, key string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failed += uint64(len(lines))
+	if s.replaying {
+		return
+	}
+	if s.Dir == "" {
+		// send the failed batch to stdout
+		fmt.Println(strings.Join(lines, "\n"))
+		return
+	}
+	if err := s.writeFile(name, key, lines); err != nil {
+		log.Errorf("could not spool %d lines for %s: %s", len(lines), name, err)
+		// stdout is the last resort so the lines aren't lost
+		fmt.Println(strings.Join(lines, "\n"))
+	}
+}
+
+// writeFile writes to a temporary file and renames it, so replay never sees half a batch.
+// names sort in the order the batches failed
+func (s *spool) writeFile(name, key string, lines []string) error {
+	dir := filepath.Join(s.Dir, name, key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	s.seq++
+	base := fmt.Sprintf("%020d-%d-%06d", time.Now().UnixNano(), os.Getpid(), s.seq)
+	tmp := filepath.Join(dir, "."+base+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, l := range lines {
+		w.WriteString(l)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, base+".jsonl"))
+}
+
+// Failed is the number of lines handed to the spool so far
+func (s *spool) Failed() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.failed
+}
+
+// files lists the spooled batches of an output instance, oldest first
+func (s *spool) files(name, key string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.Dir, name, key, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	// the zero padded timestamp prefix makes lexical order chronological
+	sort.Strings(files)
+	return files, nil
+}
+
+// failedLines collects the lines an output's workers failed to deliver one by one, and hands
+// them to the spool in batches instead of one spool file per line
+type failedLines struct {
+	name  string
+	key   string
+	lock  sync.Mutex
+	lines []string
+}
+
+func newFailedLines(name, key string) *failedLines {
+	return &failedLines{name: name, key: key}
+}
+
+func (f *failedLines) Add(line string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.lines = append(f.lines, line)
+	// counted right away, the lines are only spooled once there's enough of them
+	globalMetrics.failed.WithLabelValues(f.name).Inc()
+	if len(f.lines) >= 1000 {
+		globalSpool.store(f.name, f.key, f.lines)
+		f.lines = nil
+	}
+}
+
+// Flush spools whatever is collected so far, call it when the output is closed
+func (f *failedLines) Flush() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	globalSpool.store(f.name, f.key, f.lines)
+	f.lines = nil
+}
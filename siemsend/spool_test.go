@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// standIn is a HTTP collector that answers each request with the next status of plan, 200 once
+// the plan runs out, and keeps the lines of the requests it accepted in order
+type standIn struct {
+	lock      sync.Mutex
+	plan      []int
+	posts     int
+	delivered []string
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.posts++
+	status := http.StatusOK
+	if len(s.plan) > 0 {
+		status, s.plan = s.plan[0], s.plan[1:]
+	}
+	if status == http.StatusOK {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			s.delivered = append(s.delivered, scanner.Text())
+		}
+	}
+	w.WriteHeader(status)
+}
+
+func (s *standIn) reset(plan ...int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.plan, s.posts, s.delivered = plan, 0, nil
+}
+
+func (s *standIn) result() (int, []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.posts, s.delivered
+}
+
+func spooledLines(t *testing.T, files []string) [][]string {
+	t.Helper()
+	var batches [][]string
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batches = append(batches, strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"))
+	}
+	return batches
+}
+
+func TestSpoolRetryAndReplay(t *testing.T) {
+	dir, retries, backoff, maxBackoff := globalSpool.Dir, globalSpool.Retries, globalSpool.Backoff, globalSpool.MaxBackoff
+	t.Cleanup(func() {
+		globalSpool.Dir, globalSpool.Retries, globalSpool.Backoff, globalSpool.MaxBackoff = dir, retries, backoff, maxBackoff
+		globalSpool.replaying = false
+	})
+	collector := &standIn{}
+	srv := httptest.NewServer(collector)
+	defer srv.Close()
+
+	globalSpool.Dir = t.TempDir()
+	globalSpool.Retries = 1
+	globalSpool.Backoff = time.Millisecond
+	globalSpool.MaxBackoff = 2 * time.Millisecond
+
+	h := &httpOutput{URL: srv.URL, Method: "POST", ContentType: "application/x-ndjson", BatchSize: 2, Timeout: 5 * time.Second}
+	if err := h.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// the first batch fails its attempt and its retry, the second one goes through on the retry
+	// and the third one fails again
+	collector.reset(503, 503, 503, 200, 503, 503)
+	for _, line := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`, `{"n":4}`, `{"n":5}`, `{"n":6}`} {
+		h.Send(line)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	posts, delivered := collector.result()
+	if posts != 6 {
+		t.Errorf("got %d requests, want 6 with the retries", posts)
+	}
+	if want := []string{`{"n":3}`, `{"n":4}`}; !reflect.DeepEqual(delivered, want) {
+		t.Errorf("delivered %v, want %v", delivered, want)
+	}
+
+	files, err := globalSpool.files("http", h.spoolKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{`{"n":1}`, `{"n":2}`}, {`{"n":5}`, `{"n":6}`}}
+	if got := spooledLines(t, files); !reflect.DeepEqual(got, want) {
+		t.Fatalf("spooled %v, want %v", got, want)
+	}
+	other := &httpOutput{URL: srv.URL + "/other"}
+	if files, _ := globalSpool.files("http", other.spoolKey()); len(files) != 0 {
+		t.Errorf("another instance of the output sees %d spool files", len(files))
+	}
+
+	// the first line of the oldest file goes through and the second one doesn't. replay stops
+	// there and both files stay
+	args := []string{"--spool", globalSpool.Dir, "--retries", "0", "--url", srv.URL, "--batch-size", "1"}
+	collector.reset(200, 503)
+	if err := replaySpool("http", args); err == nil {
+		t.Fatal("replay with a failed line returned no error")
+	}
+	if left, _ := globalSpool.files("http", h.spoolKey()); !reflect.DeepEqual(left, files) {
+		t.Fatalf("spool files after a failed replay are %v, want %v", left, files)
+	}
+
+	collector.reset()
+	if err := replaySpool("http", args); err != nil {
+		t.Fatal(err)
+	}
+	if _, delivered := collector.result(); !reflect.DeepEqual(delivered, []string{`{"n":1}`, `{"n":2}`, `{"n":5}`, `{"n":6}`}) {
+		t.Errorf("replay delivered %v, want the spooled batches oldest first", delivered)
+	}
+	if left, _ := globalSpool.files("http", h.spoolKey()); len(left) != 0 {
+		t.Errorf("%d spool files left after a full replay", len(left))
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// syslogOutput sends each line as a syslog message over UDP, TCP or TLS. the message is the line
+// itself, or the line converted to CEF or LEEF
+type syslogOutput struct {
+	Address       string
+	Protocol      string
+	Format        string
+	Framing       string
+	MessageFormat string
+	Mapping       string
+	Facility      int
+	Severity      int
+	Hostname      string
+	AppName       string
+	MsgID         string
+	Timeout       time.Duration
+	TLS           tlsOptions
+	conn          net.Conn
+	mapping       *cefMapping
+	failed        *failedLines
+}
+
+var _ = syslogOutput{}.init()
+
+func (s syslogOutput) init() error {
+	syslogCmd := &cobra.Command{
+		Use:   "syslog [arguments]",
+		Short: "send input data to a syslog server, optionally as CEF or LEEF",
+		Long:  `each line is sent as one syslog message, in RFC 5424 or RFC 3164 format, over UDP, TCP or TLS. with --message-format cef or leef the JSON fields are converted using the --mapping file.`,
+		Args:  cobra.ExactArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			runOutput(&s)
+		},
+	}
+	s.flags(syslogCmd.Flags())
+	outputs["syslog"] = func(flags *pflag.FlagSet) GenericOutput {
+		o := &syslogOutput{}
+		o.flags(flags)
+		return o
+	}
+	rootCmd.AddCommand(syslogCmd)
+	return nil
+}
+
+func (s *syslogOutput) flags(flags *pflag.FlagSet) {
+	hostname, _ := os.Hostname()
+	flags.StringVarP(&s.Address, "address", "a", "", "syslog server as host:port")
+	flags.StringVarP(&s.Protocol, "protocol", "", "udp", "udp, tcp or tls")
+	flags.StringVarP(&s.Format, "format", "", "rfc5424", "rfc5424 or rfc3164")
+	flags.StringVarP(&s.Framing, "framing", "", "newline", "message framing over tcp and tls: newline or octet-counting")
+	flags.StringVarP(&s.MessageFormat, "message-format", "", "json", "json sends the line as is, cef or leef convert it using --mapping")
+	flags.StringVarP(&s.Mapping, "mapping", "", "", "JSON file mapping event fields to CEF/LEEF header fields and extensions")
+	flags.IntVarP(&s.Facility, "facility", "", 1, "syslog facility number, 1 is user, 16-23 are local0-local7")
+	flags.IntVarP(&s.Severity, "severity", "", 6, "syslog severity number, 6 is informational")
+	flags.StringVarP(&s.Hostname, "hostname", "", hostname, "hostname in the syslog header")
+	flags.StringVarP(&s.AppName, "app-name", "", "siemsend", "app name (tag in RFC 3164) in the syslog header")
+	flags.StringVarP(&s.MsgID, "msg-id", "", "-", "RFC 5424 MSGID")
+	flags.DurationVarP(&s.Timeout, "timeout", "", 10*time.Second, "connect and write timeout")
+	s.TLS.flags(flags)
+}
+
+func (s *syslogOutput) spoolKey() string {
+	return spoolKey(s.Address)
+}
+
+func (s *syslogOutput) Init() error {
+	if s.Address == "" {
+		return fmt.Errorf("--address is required")
+	}
+	switch s.Protocol {
+	case "udp", "tcp", "tls":
+	default:
+		return fmt.Errorf("unknown protocol %s", s.Protocol)
+	}
+	if s.Format != "rfc5424" && s.Format != "rfc3164" {
+		return fmt.Errorf("unknown format %s", s.Format)
+	}
+	if s.Framing != "newline" && s.Framing != "octet-counting" {
+		return fmt.Errorf("unknown framing %s", s.Framing)
+	}
+	if s.Facility < 0 || s.Facility > 23 || s.Severity < 0 || s.Severity > 7 {
+		return fmt.Errorf("facility must be 0-23 and severity 0-7")
+	}
+	switch s.MessageFormat {
+	case "json":
+	case "cef", "leef":
+		m, err := loadCEFMapping(s.Mapping)
+		if err != nil {
+			return err
+		}
+		s.mapping = m
+	default:
+		return fmt.Errorf("unknown message format %s", s.MessageFormat)
+	}
+	s.failed = newFailedLines("syslog", s.spoolKey())
+	return s.connect()
+}
+
+func (s *syslogOutput) connect() error {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	dialer := &net.Dialer{Timeout: s.Timeout}
+	var conn net.Conn
+	var err error
+	if s.Protocol == "tls" {
+		var tlsConfig *tls.Config
+		tlsConfig, err = s.TLS.Config()
+		if err != nil {
+			return err
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.Address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial(s.Protocol, s.Address)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// rfc5424Time is an RFC 3339 timestamp with microseconds, RFC 5424 6.2.3 allows at most 6 digits
+// of fractional seconds
+const rfc5424Time = "2006-01-02T15:04:05.000000Z07:00"
+
+// message builds the syslog message of a line, with its framing
+func (s *syslogOutput) message(line string, now time.Time) string {
+	msg := line
+	if s.mapping != nil {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err == nil {
+			if s.MessageFormat == "cef" {
+				msg = s.mapping.CEF(event)
+			} else {
+				msg = s.mapping.LEEF(event)
+			}
+		}
+	}
+	pri := s.Facility*8 + s.Severity
+	var out string
+	if s.Format == "rfc5424" {
+		// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+		out = fmt.Sprintf("<%d>1 %s %s %s %d %s - %s", pri, now.Format(rfc5424Time),
+			syslogHeaderField(s.Hostname), syslogHeaderField(s.AppName), os.Getpid(), syslogHeaderField(s.MsgID), msg)
+	} else {
+		// <PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG
+		out = fmt.Sprintf("<%d>%s %s %s[%d]: %s", pri, now.Format(time.Stamp),
+			syslogHeaderField(s.Hostname), syslogHeaderField(s.AppName), os.Getpid(), msg)
+	}
+	if s.Protocol == "udp" {
+		// every datagram is one message
+		return out
+	}
+	if s.Framing == "octet-counting" {
+		// RFC 6587 3.4.1
+		return strconv.Itoa(len(out)) + " " + out
+	}
+	// newlines inside the message would split it in two
+	return strings.ReplaceAll(out, "\n", " ") + "\n"
+}
+
+// syslogHeaderField replaces characters that aren't allowed in header fields, "-" means empty
+func syslogHeaderField(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, v)
+}
+
+func (s *syslogOutput) write(msg string) error {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.Timeout))
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		// reconnect on the next try
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *syslogOutput) Send(line string) {
+	msg := s.message(line, time.Now())
+	if err := globalSpool.retry("syslog", func() error { return s.write(msg) }); err != nil {
+		log.Errorf("syslog message not sent: %s", err)
+		s.failed.Add(line)
+		return
+	}
+	globalMetrics.sent("syslog", 1, len(msg))
+}
+
+// Flush spools the messages that failed, the rest are written as they're sent
+func (s *syslogOutput) Flush() error {
+	s.failed.Flush()
+	return nil
+}
+
+func (s *syslogOutput) Close() error {
+	s.failed.Flush()
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSyslog(address, protocol, format, framing string) *syslogOutput {
+	return &syslogOutput{
+		Address:       address,
+		Protocol:      protocol,
+		Format:        format,
+		Framing:       framing,
+		MessageFormat: "json",
+		Facility:      1,
+		Severity:      6,
+		Hostname:      "web01",
+		AppName:       "siemsend",
+		MsgID:         "-",
+		Timeout:       5 * time.Second,
+	}
+}
+
+// readOctetCounted splits an RFC 6587 octet-counting stream into its messages
+func readOctetCounted(r *bufio.Reader) ([]string, error) {
+	var msgs []string
+	for {
+		n, err := r.ReadString(' ')
+		if err == io.EOF && n == "" {
+			return msgs, nil
+		}
+		if err != nil {
+			return msgs, fmt.Errorf("reading the length of a message: %w", err)
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(n, " "))
+		if err != nil {
+			return msgs, fmt.Errorf("bad message length %q", n)
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return msgs, fmt.Errorf("reading a message of %d bytes: %w", size, err)
+		}
+		msgs = append(msgs, string(msg))
+	}
+}
+
+func TestSyslogTCPOctetCountingRFC5424(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var msgs []string
+	done := make(chan error)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		msgs, err = readOctetCounted(bufio.NewReader(conn))
+		done <- err
+	}()
+
+	s := newTestSyslog(ln.Addr().String(), "tcp", "rfc5424", "octet-counting")
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{`{"msg":"one"}`, `{"msg":"two\nlines"}`}
+	for _, line := range lines {
+		s.Send(line)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != len(lines) {
+		t.Fatalf("got %d messages, want %d: %q", len(msgs), len(lines), msgs)
+	}
+	// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG, with at most 6 digits
+	// of fractional seconds
+	header := regexp.MustCompile(`^<14>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}(Z|[+-]\d\d:\d\d) web01 siemsend \d+ - - (.*)$`)
+	for i, msg := range msgs {
+		m := header.FindStringSubmatch(msg)
+		if m == nil {
+			t.Errorf("message %q doesn't have an RFC 5424 header", msg)
+			continue
+		}
+		if m[2] != lines[i] {
+			t.Errorf("message %d is %q, want %q", i, m[2], lines[i])
+		}
+	}
+}
+
+func TestSyslogUDPRFC3164(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	s := newTestSyslog(pc.LocalAddr().String(), "udp", "rfc3164", "newline")
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	s.Send(`{"msg":"one"}`)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// <PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG, a datagram has no framing
+	header := regexp.MustCompile(`^<14>[A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d web01 siemsend\[\d+\]: \{"msg":"one"\}$`)
+	if msg := string(buf[:n]); !header.MatchString(msg) {
+		t.Errorf("datagram %q doesn't have an RFC 3164 header", msg)
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fingerprintSize is how much of the start of a file identifies it. a rotated file keeps its
+// fingerprint under its new name, so it's picked up where it was left
+const fingerprintSize = 1024
+
+// source is where the lines come from: stdin, or files that are followed as they grow. the read
+// offsets of files are stored in a checkpoint file so a restart continues where the last run left
+type source struct {
+	Inputs             []string
+	Checkpoint         string
+	PollInterval       time.Duration
+	CheckpointInterval time.Duration
+
+	lines chan inputLine
+	stop  chan struct{}
+	tick  <-chan time.Time
+	wg    sync.WaitGroup
+	lock  sync.Mutex
+	// state is the offset of the last line handed to the output, by path. acked is the offset
+	// of the last line the output delivered, which is what the checkpoint file holds
+	state   map[string]checkpointEntry
+	acked   map[string]checkpointEntry
+	changed bool
+	// tailing is the set of paths a tailer is following
+	tailing map[string]bool
+}
+
+// inputLine is a line along with where it ends in its file, so it can be checkpointed once the
+// output has delivered it. path is empty for stdin. flush is set instead of a line when it's
+// time to flush the output and Commit the checkpoint
+type inputLine struct {
+	text   string
+	path   string
+	offset int64
+	fp     fingerprint
+	flush  bool
+}
+
+type fingerprint struct {
+	Hash string `json:"fingerprint"`
+	Size int64  `json:"fingerprint_size"`
+}
+
+type checkpointEntry struct {
+	Offset int64 `json:"offset"`
+	fingerprint
+}
+
+type checkpointFile struct {
+	Files map[string]checkpointEntry `json:"files"`
+}
+
+var globalSource = &source{}
+
+var _ = globalSource.init()
+
+func (s *source) init() error {
+	flags := rootCmd.PersistentFlags()
+	flags.StringArrayVarP(&s.Inputs, "input", "", []string{"-"}, "where to read lines from: - for stdin, file://path to follow a file, or dir://path?glob=*.json to follow every matching file in a directory. can be repeated")
+	flags.StringVarP(&s.Checkpoint, "checkpoint", "", "", "file the read offsets of file:// and dir:// inputs are stored in, so a restart doesn't send them again")
+	flags.DurationVarP(&s.PollInterval, "poll-interval", "", time.Second, "how often files are checked for new lines, rotation and truncation")
+	flags.DurationVarP(&s.CheckpointInterval, "checkpoint-interval", "", 5*time.Second, "how often the output is flushed and the checkpoint written, it's also written on exit")
+	return nil
+}
+
+// Start loads the checkpoint and starts reading every input. SIGINT and SIGTERM stop the inputs,
+// so the output can flush and the checkpoint is written before siemsend exits
+func (s *source) Start() error {
+	s.lines = make(chan inputLine)
+	s.stop = make(chan struct{})
+	s.state = make(map[string]checkpointEntry)
+	s.acked = make(map[string]checkpointEntry)
+	s.tailing = make(map[string]bool)
+	if s.Checkpoint != "" {
+		b, err := os.ReadFile(s.Checkpoint)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			var c checkpointFile
+			if err := json.Unmarshal(b, &c); err != nil {
+				return fmt.Errorf("%s: %w", s.Checkpoint, err)
+			}
+			for path, e := range c.Files {
+				s.state[path] = e
+				s.acked[path] = e
+			}
+		}
+	}
+
+	for _, input := range s.Inputs {
+		if input == "-" || input == "stdin" {
+			s.wg.Add(1)
+			go s.readStdin()
+			continue
+		}
+		u, err := url.Parse(input)
+		if err != nil {
+			return err
+		}
+		// file://relative/path has the first element as the host
+		path := u.Host + u.Path
+		fromEnd := u.Query().Get("start") == "end"
+		switch u.Scheme {
+		case "file":
+			s.follow(path, fromEnd)
+		case "dir":
+			glob := u.Query().Get("glob")
+			if glob == "" {
+				glob = "*"
+			}
+			if _, err := filepath.Match(glob, ""); err != nil {
+				return fmt.Errorf("%s: %w", input, err)
+			}
+			s.wg.Add(1)
+			go s.watchDir(path, glob, fromEnd)
+		default:
+			return fmt.Errorf("unknown input %s, use -, file:// or dir://", input)
+		}
+	}
+	go func() {
+		s.wg.Wait()
+		close(s.lines)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Warnf("%s received, stopping", sig)
+		close(s.stop)
+		signal.Stop(signals)
+	}()
+
+	if s.Checkpoint != "" {
+		s.tick = time.NewTicker(s.CheckpointInterval).C
+	}
+	return nil
+}
+
+// Next returns the next line from any input. ok is false when every input is done, or siemsend
+// is stopping. every --checkpoint-interval it returns a line with flush set instead, if any line
+// was read since the last Commit
+func (s *source) Next() (inputLine, bool) {
+	for {
+		select {
+		case <-s.stop:
+			return inputLine{}, false
+		case l, ok := <-s.lines:
+			return l, ok
+		case <-s.tick:
+			s.lock.Lock()
+			changed := s.changed
+			s.lock.Unlock()
+			if changed {
+				return inputLine{flush: true}, true
+			}
+		}
+	}
+}
+
+// Done records that a line was handed to the output. the checkpoint moves past it on the next
+// Commit, once the output has flushed it
+func (s *source) Done(l inputLine) {
+	if l.path == "" {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state[l.path] = checkpointEntry{Offset: l.offset, fingerprint: l.fp}
+	s.changed = true
+}
+
+// Commit moves the checkpoint past every line handed to the output so far and writes it. call
+// it only after the output has flushed them
+func (s *source) Commit() error {
+	if s.Checkpoint == "" {
+		return nil
+	}
+	s.lock.Lock()
+	for path, e := range s.state {
+		s.acked[path] = e
+	}
+	s.changed = false
+	s.lock.Unlock()
+	return s.save()
+}
+
+// Close writes the checkpoint one last time, call it after the output is closed
+func (s *source) Close() error {
+	return s.Commit()
+}
+
+// save writes the checkpoint to a temporary file and renames it, so it's never half written
+func (s *source) save() error {
+	s.lock.Lock()
+	b, err := json.MarshalIndent(checkpointFile{Files: s.acked}, "", "  ")
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := s.Checkpoint + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Checkpoint)
+}
+
+// send hands a line to Next, giving up when siemsend is stopping
+func (s *source) send(l inputLine) bool {
+	select {
+	case <-s.stop:
+		return false
+	case s.lines <- l:
+		return true
+	}
+}
+
+func (s *source) readStdin() {
+	defer s.wg.Done()
+	err := readLines(os.Stdin, func(line string) bool {
+		return s.send(inputLine{text: line})
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// readLines calls fn with every line of r until r ends or fn returns false. unlike a
+// bufio.Scanner there's no limit on the length of a line
+func readLines(r io.Reader, fn func(line string) bool) error {
+	br := bufio.NewReaderSize(r, 640*1024)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			if !fn(line) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// watchDir follows every file matching glob in dir, including the ones created later
+func (s *source) watchDir(dir, glob string, fromEnd bool) {
+	defer s.wg.Done()
+	tick := time.NewTicker(s.PollInterval)
+	defer tick.Stop()
+	// only the files that are there at startup start from the end with start=end, new files are
+	// read in full
+	first := true
+	for {
+		paths, err := filepath.Glob(filepath.Join(dir, glob))
+		if err != nil {
+			log.Errorf("%s: %s", dir, err)
+		}
+		for _, path := range paths {
+			if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			s.follow(path, fromEnd && first)
+		}
+		first = false
+		select {
+		case <-s.stop:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// follow starts a tailer for path unless one is following it already
+func (s *source) follow(path string, fromEnd bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.tailing[path] {
+		return
+	}
+	s.tailing[path] = true
+	s.wg.Add(1)
+	go s.tail(path, fromEnd)
+}
+
+// tailer follows one path. when the file at the path is replaced (rotated) the old file is read
+// to the end before the new one is opened, and when it's truncated it's read again from the start
+type tailer struct {
+	path   string
+	f      *os.File
+	fi     os.FileInfo
+	r      *bufio.Reader
+	offset int64
+	fp     fingerprint
+}
+
+func (s *source) tail(path string, fromEnd bool) {
+	defer s.wg.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.tailing, path)
+		s.lock.Unlock()
+	}()
+	t := &tailer{path: path}
+	defer t.close()
+
+	tick := time.NewTicker(s.PollInterval)
+	defer tick.Stop()
+	for {
+		if t.f == nil {
+			if err := s.open(t, fromEnd); err != nil {
+				if !os.IsNotExist(err) {
+					log.Errorf("%s: %s", path, err)
+				}
+			}
+			// a file that replaces this one is read from the start
+			fromEnd = false
+		}
+		if t.f != nil {
+			// checked before reading, or the lines written after the truncation would be read
+			// from the old offset. a file that's truncated and written to again before the next
+			// poll can be as big as before, but it won't start the same
+			if fi, err := t.f.Stat(); err == nil && (fi.Size() < t.offset || !t.matches(t.fp, fi.Size())) {
+				log.Warnf("%s was truncated, reading it from the start", path)
+				if _, err := t.f.Seek(0, io.SeekStart); err == nil {
+					t.r.Reset(t.f)
+					t.offset = 0
+					t.fp = fingerprint{}
+				}
+			}
+			if !s.readLines(t, false) {
+				return
+			}
+			switch fi, err := os.Stat(path); {
+			case os.IsNotExist(err) && !s.tailingFile(t):
+				// the file is gone for good, dir:// picks it up again if it comes back
+				s.readLines(t, true)
+				return
+			case err != nil:
+			case !os.SameFile(fi, t.fi):
+				log.Infof("%s was rotated, reading the new file", path)
+				// whatever was written to the old file after the last read, and a last line
+				// without a newline
+				if !s.readLines(t, true) {
+					return
+				}
+				t.close()
+				continue
+			}
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// tailingFile is true for file:// inputs, which wait for a deleted file to come back. dir://
+// tailers stop instead
+func (s *source) tailingFile(t *tailer) bool {
+	for _, input := range s.Inputs {
+		if u, err := url.Parse(input); err == nil && u.Scheme == "file" && u.Host+u.Path == t.path {
+			return true
+		}
+	}
+	return false
+}
+
+// open opens the file at the path of t and seeks to where the checkpoint says it was left.
+// the checkpoint of another path is used when the fingerprint matches, which is the case when
+// the file was renamed by log rotation
+func (s *source) open(t *tailer, fromEnd bool) error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	t.f, t.fi, t.offset, t.fp = f, fi, 0, fingerprint{}
+	t.r = bufio.NewReader(f)
+
+	offset, found := s.resumeOffset(t)
+	switch {
+	case found:
+		log.Infof("%s: resuming at offset %d", t.path, offset)
+	case fromEnd:
+		offset = fi.Size()
+	}
+	if offset > fi.Size() {
+		log.Warnf("%s is smaller than its checkpoint, reading it from the start", t.path)
+		offset = 0
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			t.close()
+			return err
+		}
+		t.offset = offset
+	}
+	t.updateFingerprint()
+	return nil
+}
+
+func (s *source) resumeOffset(t *tailer) (int64, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e, ok := s.state[t.path]; ok && t.matches(e.fingerprint, t.fi.Size()) {
+		return e.Offset, true
+	}
+	// short fingerprints, like a csv header, could match unrelated files
+	for path, e := range s.state {
+		if path != t.path && e.Size == fingerprintSize && t.matches(e.fingerprint, t.fi.Size()) {
+			return e.Offset, true
+		}
+	}
+	return 0, false
+}
+
+// matches is true when the start of the open file, size bytes long, hashes to fp
+func (t *tailer) matches(fp fingerprint, size int64) bool {
+	if fp.Size > size {
+		return false
+	}
+	h, err := t.hash(fp.Size)
+	return err == nil && h == fp.Hash
+}
+
+func (t *tailer) hash(size int64) (string, error) {
+	b := make([]byte, size)
+	if _, err := t.f.ReadAt(b, 0); err != nil && err != io.EOF {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// updateFingerprint hashes the start of the file until it's fingerprintSize long
+func (t *tailer) updateFingerprint() {
+	if t.fp.Size == fingerprintSize || t.fp.Size == t.offset {
+		return
+	}
+	size := t.offset
+	if size > fingerprintSize {
+		size = fingerprintSize
+	}
+	if h, err := t.hash(size); err == nil {
+		t.fp = fingerprint{Hash: h, Size: size}
+	}
+}
+
+// readLines sends every complete line that's been written since the last read. with final set,
+// a last line without a newline is sent too, for files that won't grow any more. it returns
+// false when siemsend is stopping
+func (s *source) readLines(t *tailer, final bool) bool {
+	for {
+		line, err := t.r.ReadBytes('\n')
+		if err != nil {
+			if len(line) != 0 {
+				if final {
+					t.offset += int64(len(line))
+					t.updateFingerprint()
+					return s.send(inputLine{text: string(line), path: t.path, offset: t.offset, fp: t.fp})
+				}
+				// not a full line yet, read it again on the next poll
+				if _, err := t.f.Seek(t.offset, io.SeekStart); err == nil {
+					t.r.Reset(t.f)
+				}
+			}
+			if err != io.EOF {
+				log.Errorf("%s: %s", t.path, err)
+			}
+			return true
+		}
+		t.offset += int64(len(line))
+		t.updateFingerprint()
+		text := strings.TrimRight(string(bytes.TrimSuffix(line, []byte("\n"))), "\r")
+		if !s.send(inputLine{text: text, path: t.path, offset: t.offset, fp: t.fp}) {
+			return false
+		}
+	}
+}
+
+func (t *tailer) close() {
+	if t.f != nil {
+		t.f.Close()
+		t.f = nil
+	}
+}
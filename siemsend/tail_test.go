@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// startTestSource follows path with a short poll interval. the periodic checkpoint is left to
+// the tests, which call Commit themselves
+func startTestSource(t *testing.T, path, checkpoint string) *source {
+	t.Helper()
+	s := &source{
+		Inputs:             []string{"file://" + path},
+		Checkpoint:         checkpoint,
+		PollInterval:       10 * time.Millisecond,
+		CheckpointInterval: time.Hour,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// nextLines reads n lines from s and marks them as handed to the output, like runOutput does
+func nextLines(t *testing.T, s *source, n int) []string {
+	t.Helper()
+	var lines []string
+	for len(lines) < n {
+		next := make(chan inputLine, 1)
+		go func() {
+			if l, ok := s.Next(); ok {
+				next <- l
+			}
+		}()
+		select {
+		case l := <-next:
+			if l.flush {
+				continue
+			}
+			s.Done(l)
+			lines = append(lines, l.text)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %q, timed out waiting for %d lines", lines, n)
+		}
+	}
+	return lines
+}
+
+func appendFile(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTailRenameRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendFile(t, path, "1\n2\n")
+	s := startTestSource(t, path, "")
+	defer close(s.stop)
+	if got := nextLines(t, s, 2); !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Fatalf("got %q", got)
+	}
+
+	// a line written to the old file right before it's renamed is read before the new file
+	appendFile(t, path, "3\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "4\n5\n")
+	if got := nextLines(t, s, 3); !reflect.DeepEqual(got, []string{"3", "4", "5"}) {
+		t.Errorf("after rotation got %q, want 3, 4 and 5", got)
+	}
+}
+
+func TestTailCopyTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendFile(t, path, "1\n2\n3\n")
+	s := startTestSource(t, path, "")
+	defer close(s.stop)
+	if got := nextLines(t, s, 3); !reflect.DeepEqual(got, []string{"1", "2", "3"}) {
+		t.Fatalf("got %q", got)
+	}
+
+	// truncated and written to again before the next poll, the file is larger than before but
+	// doesn't start the same
+	if err := os.WriteFile(path, []byte("4444444444\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := nextLines(t, s, 1); !reflect.DeepEqual(got, []string{"4444444444"}) {
+		t.Errorf("after truncation got %q", got)
+	}
+	appendFile(t, path, "5\n")
+	if got := nextLines(t, s, 1); !reflect.DeepEqual(got, []string{"5"}) {
+		t.Errorf("after truncation got %q", got)
+	}
+}
+
+func TestTailRestartFromCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	checkpoint := filepath.Join(dir, "checkpoint.json")
+	appendFile(t, path, "1\n2\n3\n")
+
+	s := startTestSource(t, path, checkpoint)
+	nextLines(t, s, 3)
+	// the output flushed the first three lines
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// the next two are handed to the output but still in its batch when siemsend crashes
+	appendFile(t, path, "4\n5\n")
+	nextLines(t, s, 2)
+	close(s.stop)
+
+	s = startTestSource(t, path, checkpoint)
+	if got := nextLines(t, s, 2); !reflect.DeepEqual(got, []string{"4", "5"}) {
+		t.Fatalf("after a crash got %q, want the lines that weren't flushed", got)
+	}
+	appendFile(t, path, "6\n")
+	nextLines(t, s, 1)
+	close(s.stop)
+	// a clean stop closes the output and then the source
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	appendFile(t, path, "7\n")
+	s = startTestSource(t, path, checkpoint)
+	defer close(s.stop)
+	if got := nextLines(t, s, 1); !reflect.DeepEqual(got, []string{"7"}) {
+		t.Errorf("after a clean stop got %q, want only the new line", got)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+)
+
+// tlsOptions are the TLS flags shared by the outputs that talk to a server over TLS
+type tlsOptions struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	SkipVerify bool
+}
+
+func (t *tlsOptions) flags(flags *pflag.FlagSet) {
+	flags.StringVarP(&t.CAFile, "ca-file", "", "", "PEM file with the CA certificates used to verify the server")
+	flags.StringVarP(&t.CertFile, "cert-file", "", "", "PEM client certificate for mutual TLS")
+	flags.StringVarP(&t.KeyFile, "key-file", "", "", "PEM private key of --cert-file")
+	flags.BoolVarP(&t.SkipVerify, "skip-tls-verify", "", false, "skip TLS verification")
+}
+
+// Config builds a tls.Config from the flags. the system CAs are used when --ca-file is empty
+func (t tlsOptions) Config() (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: t.SkipVerify}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// transformStep is one entry of the transform file. exactly one of its fields is set,
+// and the steps run in the order they're written
+type transformStep struct {
+	// DropIf drops the events matching a filter expression
+	DropIf string `yaml:"drop_if"`
+	// KeepIf drops the events not matching a filter expression
+	KeepIf string `yaml:"keep_if"`
+	// Rename moves fields, old name to new name
+	Rename map[string]string `yaml:"rename"`
+	// Add sets fields to static values, e.g. env: prod
+	Add map[string]interface{} `yaml:"add"`
+	// Remove deletes fields
+	Remove []string `yaml:"remove"`
+	// AddTimestamp sets the named field to the time siemsend read the event
+	AddTimestamp string `yaml:"add_timestamp"`
+	// Redact replaces fields with their sha256, or HMAC-SHA256 when a key is given
+	Redact *transformRedact `yaml:"redact"`
+	// Route sets a field from a lookup table of another field's values, for outputs
+	// that pick the index or log type from a field
+	Route *transformRoute `yaml:"route"`
+
+	filter filterExpr
+}
+
+type transformRedact struct {
+	Fields []string `yaml:"fields"`
+	Key    string   `yaml:"key"`
+}
+
+type transformRoute struct {
+	Field   string            `yaml:"field"`
+	Target  string            `yaml:"target"`
+	Map     map[string]string `yaml:"map"`
+	Default string            `yaml:"default"`
+}
+
+type transformFile struct {
+	Steps []*transformStep `yaml:"steps"`
+}
+
+// transformer runs every input line through the configured steps before it reaches an output
+type transformer struct {
+	File         string
+	DropIf       []string
+	KeepIf       []string
+	Rename       []string
+	Add          []string
+	Remove       []string
+	AddTimestamp string
+	Redact       []string
+	RedactKey    string
+	steps        []*transformStep
+}
+
+var globalTransform = &transformer{}
+
+var _ = globalTransform.init()
+
+func (t *transformer) init() error {
+	flags := rootCmd.PersistentFlags()
+	flags.StringVarP(&t.File, "transform", "", "", "YAML file with the transformation steps applied to every event")
+	flags.StringArrayVarP(&t.DropIf, "drop-if", "", []string{}, "drop events matching a filter expression, e.g. 'event.severity == \"debug\"'")
+	flags.StringArrayVarP(&t.KeepIf, "keep-if", "", []string{}, "drop events not matching a filter expression")
+	flags.StringArrayVarP(&t.Rename, "rename", "", []string{}, "rename a field, as old=new")
+	flags.StringArrayVarP(&t.Add, "add", "", []string{}, "add a static field, as name=value")
+	flags.StringArrayVarP(&t.Remove, "remove", "", []string{}, "remove a field")
+	flags.StringVarP(&t.AddTimestamp, "add-timestamp", "", "", "field to store the ingest time in")
+	flags.StringArrayVarP(&t.Redact, "redact", "", []string{}, "replace a field with its sha256, or HMAC-SHA256 with --redact-key")
+	flags.StringVarP(&t.RedactKey, "redact-key", "", "", "HMAC key for --redact")
+	return nil
+}
+
+// Load builds the steps from the transform file, followed by the steps given as flags
+func (t *transformer) Load() error {
+	t.steps = nil
+	if t.File != "" {
+		b, err := os.ReadFile(t.File)
+		if err != nil {
+			return err
+		}
+		var f transformFile
+		if err := yaml.Unmarshal(b, &f); err != nil {
+			return fmt.Errorf("%s: %w", t.File, err)
+		}
+		t.steps = append(t.steps, f.Steps...)
+	}
+	for _, e := range t.DropIf {
+		t.steps = append(t.steps, &transformStep{DropIf: e})
+	}
+	for _, e := range t.KeepIf {
+		t.steps = append(t.steps, &transformStep{KeepIf: e})
+	}
+	if len(t.Rename) != 0 {
+		step := &transformStep{Rename: map[string]string{}}
+		for _, r := range t.Rename {
+			old, new, ok := strings.Cut(r, "=")
+			if !ok {
+				return fmt.Errorf("--rename %q is not in old=new format", r)
+			}
+			step.Rename[old] = new
+		}
+		t.steps = append(t.steps, step)
+	}
+	if len(t.Add) != 0 {
+		step := &transformStep{Add: map[string]interface{}{}}
+		for _, a := range t.Add {
+			k, v, ok := strings.Cut(a, "=")
+			if !ok {
+				return fmt.Errorf("--add %q is not in name=value format", a)
+			}
+			step.Add[k] = v
+		}
+		t.steps = append(t.steps, step)
+	}
+	if len(t.Remove) != 0 {
+		t.steps = append(t.steps, &transformStep{Remove: t.Remove})
+	}
+	if t.AddTimestamp != "" {
+		t.steps = append(t.steps, &transformStep{AddTimestamp: t.AddTimestamp})
+	}
+	if len(t.Redact) != 0 {
+		t.steps = append(t.steps, &transformStep{Redact: &transformRedact{Fields: t.Redact, Key: t.RedactKey}})
+	}
+
+	for i, s := range t.steps {
+		var err error
+		switch {
+		case s.DropIf != "":
+			s.filter, err = parseFilter(s.DropIf)
+		case s.KeepIf != "":
+			s.filter, err = parseFilter(s.KeepIf)
+		case s.Route != nil && (s.Route.Field == "" || s.Route.Target == ""):
+			err = fmt.Errorf("route needs a field and a target")
+		}
+		if err != nil {
+			return fmt.Errorf("transform step %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Apply runs a line through the steps. ok is false when the event is dropped. lines that
+// aren't JSON objects are passed through untouched
+func (t *transformer) Apply(line string) (string, bool) {
+	if len(t.steps) == 0 {
+		return line, true
+	}
+	dec := json.NewDecoder(strings.NewReader(line))
+	// keep large integers as they are instead of turning them into floats
+	dec.UseNumber()
+	var event map[string]interface{}
+	if err := dec.Decode(&event); err != nil || event == nil {
+		return line, true
+	}
+	now := time.Now()
+	for _, s := range t.steps {
+		if !s.apply(event, now) {
+			return "", false
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(event); err != nil {
+		return line, true
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), true
+}
+
+func (s *transformStep) apply(event map[string]interface{}, now time.Time) bool {
+	switch {
+	case s.DropIf != "":
+		return !s.filter.eval(event)
+	case s.KeepIf != "":
+		return s.filter.eval(event)
+	}
+	for old, new := range s.Rename {
+		if v, ok := getField(event, old); ok {
+			deleteField(event, old)
+			setField(event, new, v)
+		}
+	}
+	for k, v := range s.Add {
+		setField(event, k, v)
+	}
+	for _, f := range s.Remove {
+		deleteField(event, f)
+	}
+	if s.AddTimestamp != "" {
+		setField(event, s.AddTimestamp, now.UTC().Format(time.RFC3339Nano))
+	}
+	if s.Redact != nil {
+		for _, f := range s.Redact.Fields {
+			v, ok := getField(event, f)
+			if !ok || v == nil {
+				continue
+			}
+			var h hash.Hash
+			if s.Redact.Key != "" {
+				h = hmac.New(sha256.New, []byte(s.Redact.Key))
+			} else {
+				h = sha256.New()
+			}
+			fmt.Fprint(h, v)
+			setField(event, f, hex.EncodeToString(h.Sum(nil)))
+		}
+	}
+	if s.Route != nil {
+		target := s.Route.Default
+		if v, ok := s.Route.Map[getFieldString(event, s.Route.Field)]; ok {
+			target = v
+		}
+		if target != "" {
+			setField(event, s.Route.Target, target)
+		}
+	}
+	return true
+}